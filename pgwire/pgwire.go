@@ -0,0 +1,533 @@
+// Package pgwire implements a small part of the Postgres frontend/backend protocol without a
+// database driver: connecting, authenticating, and running simple queries. It is intended for
+// tools and tests that need to check on a Postgres server, not for applications. See:
+// https://www.postgresql.org/docs/current/protocol.html
+package pgwire
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/exp/maps"
+	"golang.org/x/exp/slices"
+)
+
+// ProtocolVersion is the version of the protocol sent in the startup message (3.0).
+const ProtocolVersion = 3<<16 | 0
+
+// maximum length of a message from the server; Postgres limits values to 1 GiB
+const maxMessageLength = 1 << 30
+
+// Backend message types. See:
+// https://www.postgresql.org/docs/current/protocol-message-formats.html
+const (
+	msgAuthentication       = 'R'
+	msgBackendKeyData       = 'K'
+	msgCommandComplete      = 'C'
+	msgCopyInResponse       = 'G'
+	msgCopyOutResponse      = 'H'
+	msgCopyBothResponse     = 'W'
+	msgDataRow              = 'D'
+	msgEmptyQueryResponse   = 'I'
+	msgErrorResponse        = 'E'
+	msgNoticeResponse       = 'N'
+	msgParameterStatus      = 'S'
+	msgReadyForQuery        = 'Z'
+	msgRowDescription       = 'T'
+	msgNegotiateProtocol    = 'v'
+	msgNotificationResponse = 'A'
+)
+
+// Frontend message types.
+const (
+	msgPassword  = 'p'
+	msgQuery     = 'Q'
+	msgTerminate = 'X'
+)
+
+// Authentication request codes, sent in the first 4 bytes of an Authentication message.
+const (
+	authOK                = 0
+	authCleartextPassword = 3
+	authMD5Password       = 5
+	authSASL              = 10
+	authSASLContinue      = 11
+	authSASLFinal         = 12
+)
+
+// Message is a message read from the server.
+type Message struct {
+	// Type is the first byte of the message, such as 'E' for ErrorResponse.
+	Type byte
+	// Body is the contents of the message, without the type and length.
+	Body []byte
+}
+
+// ReadMessage reads one message from the server.
+func ReadMessage(r io.Reader) (*Message, error) {
+	var header [5]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return nil, err
+	}
+	// the length includes itself
+	length := int64(binary.BigEndian.Uint32(header[1:])) - 4
+	if length < 0 || length > maxMessageLength {
+		return nil, fmt.Errorf("pgwire: message type=%q has invalid length=%d", header[0], length)
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return nil, err
+	}
+	return &Message{header[0], body}, nil
+}
+
+// WriteMessage writes one message with msgType and body to the server.
+func WriteMessage(w io.Writer, msgType byte, body []byte) error {
+	msg := make([]byte, 0, 5+len(body))
+	msg = append(msg, msgType)
+	msg = binary.BigEndian.AppendUint32(msg, uint32(len(body)+4))
+	msg = append(msg, body...)
+	_, err := w.Write(msg)
+	return err
+}
+
+// WriteStartupMessage writes the first message on a new connection, which has no type. The
+// params must include "user", and may include "database" and other run-time parameters.
+func WriteStartupMessage(w io.Writer, params map[string]string) error {
+	var body []byte
+	body = binary.BigEndian.AppendUint32(body, ProtocolVersion)
+	// sort the keys so the message is deterministic
+	keys := maps.Keys(params)
+	slices.Sort(keys)
+	for _, key := range keys {
+		body = appendString(body, key)
+		body = appendString(body, params[key])
+	}
+	// "A zero byte is required as a terminator after the last name/value pair"
+	body = append(body, 0)
+
+	msg := binary.BigEndian.AppendUint32(nil, uint32(len(body)+4))
+	_, err := w.Write(append(msg, body...))
+	return err
+}
+
+// appendString appends s as a null-terminated string.
+func appendString(b []byte, s string) []byte {
+	return append(append(b, s...), 0)
+}
+
+// messageReader reads values from the body of a message.
+type messageReader struct {
+	body []byte
+	err  error
+}
+
+func (m *messageReader) uint32() uint32 {
+	if len(m.body) < 4 {
+		m.err = errors.New("pgwire: message is too short")
+		return 0
+	}
+	v := binary.BigEndian.Uint32(m.body)
+	m.body = m.body[4:]
+	return v
+}
+
+func (m *messageReader) uint16() uint16 {
+	if len(m.body) < 2 {
+		m.err = errors.New("pgwire: message is too short")
+		return 0
+	}
+	v := binary.BigEndian.Uint16(m.body)
+	m.body = m.body[2:]
+	return v
+}
+
+// string reads a null-terminated string.
+func (m *messageReader) string() string {
+	s, rest, found := bytes.Cut(m.body, []byte{0})
+	if !found {
+		m.err = errors.New("pgwire: string is not terminated")
+		return ""
+	}
+	m.body = rest
+	return string(s)
+}
+
+func (m *messageReader) bytes(n int) []byte {
+	if n < 0 || len(m.body) < n {
+		m.err = errors.New("pgwire: message is too short")
+		return nil
+	}
+	v := m.body[:n]
+	m.body = m.body[n:]
+	return v
+}
+
+// Error is an ErrorResponse sent by the server. See:
+// https://www.postgresql.org/docs/current/protocol-error-fields.html
+type Error struct {
+	// Severity is ERROR, FATAL, or PANIC. It is not localized.
+	Severity string
+	// Code is the SQLSTATE code, such as 57P03 for cannot_connect_now. See:
+	// https://www.postgresql.org/docs/current/errcodes-appendix.html
+	Code string
+	// Message is the primary human-readable error message.
+	Message string
+	// Detail is an optional secondary message with more details.
+	Detail string
+	// Hint is an optional suggestion about what to do about the problem.
+	Hint string
+	// Fields contains all fields in the response, keyed by their type byte.
+	Fields map[byte]string
+}
+
+// ParseError parses the body of an ErrorResponse or NoticeResponse message.
+func ParseError(body []byte) (*Error, error) {
+	e := &Error{Fields: map[byte]string{}}
+	r := &messageReader{body: body}
+	for {
+		fieldType := r.bytes(1)
+		if r.err != nil {
+			return nil, r.err
+		}
+		if fieldType[0] == 0 {
+			break
+		}
+		e.Fields[fieldType[0]] = r.string()
+		if r.err != nil {
+			return nil, r.err
+		}
+	}
+
+	// 'V' is the non-localized severity, added in Postgres 9.6; 'S' may be translated
+	e.Severity = e.Fields['V']
+	if e.Severity == "" {
+		e.Severity = e.Fields['S']
+	}
+	e.Code = e.Fields['C']
+	e.Message = e.Fields['M']
+	e.Detail = e.Fields['D']
+	e.Hint = e.Fields['H']
+	return e, nil
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("%s: %s (SQLSTATE %s)", e.Severity, e.Message, e.Code)
+	if e.Detail != "" {
+		msg += "; detail: " + e.Detail
+	}
+	if e.Hint != "" {
+		msg += "; hint: " + e.Hint
+	}
+	return msg
+}
+
+// Config describes how to connect to Postgres.
+type Config struct {
+	// Network and Address are passed to net.Dial. For example: "unix" and
+	// "/tmp/.s.PGSQL.5432", or "tcp" and "localhost:5432".
+	Network string
+	Address string
+
+	// User is the Postgres user name. It is required.
+	User string
+
+	// Password is sent if the server requests password authentication.
+	Password string
+
+	// Database to connect to. If empty, the server uses a database with the same name as User.
+	Database string
+
+	// Params are additional run-time parameters sent in the startup message, such as
+	// application_name.
+	Params map[string]string
+}
+
+// Conn is a connection to Postgres. It is not safe to use from multiple goroutines.
+type Conn struct {
+	conn   net.Conn
+	r      *bufio.Reader
+	params map[string]string
+	pid    uint32
+}
+
+// Connect opens a connection to Postgres, authenticates, and waits until the server is ready for
+// queries. If the server sends an ErrorResponse, such as when it is starting up, it returns an
+// *Error.
+func Connect(ctx context.Context, config Config) (*Conn, error) {
+	if config.User == "" {
+		return nil, errors.New("pgwire: Config.User is required")
+	}
+	var dialer net.Dialer
+	netConn, err := dialer.DialContext(ctx, config.Network, config.Address)
+	if err != nil {
+		return nil, err
+	}
+	c := &Conn{netConn, bufio.NewReader(netConn), map[string]string{}, 0}
+	err = c.withContext(ctx, func() error {
+		return c.startup(config)
+	})
+	if err != nil {
+		netConn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// withContext calls f, and interrupts any reads or writes it is doing when ctx is done.
+func (c *Conn) withContext(ctx context.Context, f func() error) error {
+	stop := context.AfterFunc(ctx, func() {
+		// a time in the past causes blocked reads and writes to return immediately
+		c.conn.SetDeadline(time.Unix(1, 0))
+	})
+	err := f()
+	if !stop() {
+		// the deadline was set: the connection cannot be used again
+		return ctx.Err()
+	}
+	return err
+}
+
+// startup sends the startup message, authenticates, then reads messages until ReadyForQuery.
+func (c *Conn) startup(config Config) error {
+	params := map[string]string{"user": config.User}
+	if config.Database != "" {
+		params["database"] = config.Database
+	}
+	for key, value := range config.Params {
+		params[key] = value
+	}
+	err := WriteStartupMessage(c.conn, params)
+	if err != nil {
+		return err
+	}
+
+	var scram *scramClient
+	for {
+		msg, err := ReadMessage(c.r)
+		if err != nil {
+			return err
+		}
+		switch msg.Type {
+		case msgErrorResponse:
+			return parseErrorResponse(msg.Body)
+
+		case msgAuthentication:
+			r := &messageReader{body: msg.Body}
+			code := r.uint32()
+			if r.err != nil {
+				return r.err
+			}
+			switch code {
+			case authOK:
+			case authCleartextPassword:
+				err = c.sendPassword(config, config.Password)
+			case authMD5Password:
+				salt := r.bytes(4)
+				if r.err != nil {
+					return r.err
+				}
+				err = c.sendPassword(config, md5Password(config.User, config.Password, salt))
+			case authSASL:
+				scram, err = c.startSCRAM(config, r.body)
+			case authSASLContinue:
+				err = c.continueSCRAM(scram, r.body)
+			case authSASLFinal:
+				if scram == nil {
+					return errors.New("pgwire: unexpected SASLFinal")
+				}
+				err = scram.verifyServerFinal(string(r.body))
+			default:
+				return fmt.Errorf("pgwire: unsupported authentication request=%d", code)
+			}
+			if err != nil {
+				return err
+			}
+
+		case msgParameterStatus:
+			r := &messageReader{body: msg.Body}
+			name := r.string()
+			value := r.string()
+			if r.err != nil {
+				return r.err
+			}
+			c.params[name] = value
+
+		case msgBackendKeyData:
+			r := &messageReader{body: msg.Body}
+			c.pid = r.uint32()
+			if r.err != nil {
+				return r.err
+			}
+
+		case msgReadyForQuery:
+			return nil
+
+		case msgNegotiateProtocol, msgNoticeResponse:
+			// the server supports an older minor version, or a warning: ignore
+
+		default:
+			return fmt.Errorf("pgwire: unexpected message type=%q during startup", msg.Type)
+		}
+	}
+}
+
+// sendPassword sends password in a PasswordMessage, or returns an error if config has no password.
+func (c *Conn) sendPassword(config Config, password string) error {
+	if config.Password == "" {
+		return errors.New("pgwire: server requested a password but Config.Password is empty")
+	}
+	return WriteMessage(c.conn, msgPassword, appendString(nil, password))
+}
+
+// md5Password returns the response to an MD5 password request. See:
+// https://www.postgresql.org/docs/current/protocol-flow.html#PROTOCOL-FLOW-START-UP
+func md5Password(user string, password string, salt []byte) string {
+	inner := md5.Sum([]byte(password + user))
+	outer := md5.Sum(append([]byte(hex.EncodeToString(inner[:])), salt...))
+	return "md5" + hex.EncodeToString(outer[:])
+}
+
+// ParameterStatus returns the value of a run-time parameter reported by the server, such as
+// server_version, or the empty string if it was not reported.
+func (c *Conn) ParameterStatus(name string) string {
+	return c.params[name]
+}
+
+// ProcessID returns the process ID of the server process handling this connection.
+func (c *Conn) ProcessID() int {
+	return int(c.pid)
+}
+
+// Result is the result of one statement executed by SimpleQuery.
+type Result struct {
+	// Columns contains the name of each column, or nil if the statement does not return rows.
+	Columns []string
+	// Rows contains the values in text format. NULL values are nil.
+	Rows [][]*string
+	// CommandTag identifies the completed command, such as "SELECT 1" or "INSERT 0 2".
+	CommandTag string
+}
+
+// SimpleQuery executes query with the simple query protocol, and returns one Result for each
+// statement. If a statement fails, it returns an *Error. COPY is not supported.
+func (c *Conn) SimpleQuery(ctx context.Context, query string) ([]*Result, error) {
+	var results []*Result
+	err := c.withContext(ctx, func() error {
+		err := WriteMessage(c.conn, msgQuery, appendString(nil, query))
+		if err != nil {
+			return err
+		}
+
+		// read until ReadyForQuery so the connection can be used again, even after an error
+		var queryErr error
+		var current *Result
+		for {
+			msg, err := ReadMessage(c.r)
+			if err != nil {
+				return err
+			}
+			r := &messageReader{body: msg.Body}
+			switch msg.Type {
+			case msgRowDescription:
+				current = &Result{}
+				numColumns := r.uint16()
+				for i := 0; i < int(numColumns); i++ {
+					current.Columns = append(current.Columns, r.string())
+					// table OID, column number, type OID, type size, type modifier, format code
+					r.bytes(4 + 2 + 4 + 2 + 4 + 2)
+				}
+
+			case msgDataRow:
+				if current == nil {
+					return errors.New("pgwire: DataRow without RowDescription")
+				}
+				numColumns := r.uint16()
+				row := make([]*string, numColumns)
+				for i := range row {
+					length := int32(r.uint32())
+					if length >= 0 {
+						value := string(r.bytes(int(length)))
+						row[i] = &value
+					}
+				}
+				current.Rows = append(current.Rows, row)
+
+			case msgCommandComplete:
+				if current == nil {
+					current = &Result{}
+				}
+				current.CommandTag = r.string()
+				results = append(results, current)
+				current = nil
+
+			case msgEmptyQueryResponse:
+				results = append(results, &Result{})
+
+			case msgErrorResponse:
+				queryErr = parseErrorResponse(msg.Body)
+
+			case msgReadyForQuery:
+				return queryErr
+
+			case msgCopyInResponse, msgCopyOutResponse, msgCopyBothResponse:
+				// the connection is in an unknown state: close it
+				c.conn.Close()
+				return errors.New("pgwire: COPY is not supported")
+
+			case msgNoticeResponse, msgParameterStatus, msgNotificationResponse:
+				// ignore asynchronous messages
+
+			default:
+				return fmt.Errorf("pgwire: unexpected message type=%q during query", msg.Type)
+			}
+			if r.err != nil {
+				return r.err
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// parseErrorResponse returns the *Error in an ErrorResponse, or the error parsing it.
+func parseErrorResponse(body []byte) error {
+	pgErr, err := ParseError(body)
+	if err != nil {
+		return err
+	}
+	return pgErr
+}
+
+// Close sends a Terminate message and closes the connection.
+func (c *Conn) Close() error {
+	// ignore the error: the connection may already be broken
+	WriteMessage(c.conn, msgTerminate, nil)
+	return c.conn.Close()
+}
+
+// splitNullTerminated splits a list of null-terminated strings, ending with an empty string.
+func splitNullTerminated(b []byte) []string {
+	var values []string
+	for _, value := range strings.Split(string(b), "\x00") {
+		if value == "" {
+			break
+		}
+		values = append(values, value)
+	}
+	return values
+}
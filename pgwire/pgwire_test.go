@@ -0,0 +1,234 @@
+package pgwire
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestParseError(t *testing.T) {
+	body := []byte("SFATAL\x00VFATAL\x00C57P03\x00Mthe database system is starting up\x00" +
+		"Dsome detail\x00Fpostmaster.c\x00\x00")
+	pgErr, err := ParseError(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pgErr.Severity != "FATAL" || pgErr.Code != "57P03" ||
+		pgErr.Message != "the database system is starting up" || pgErr.Detail != "some detail" {
+		t.Errorf("unexpected error fields: %#v", pgErr)
+	}
+	if pgErr.Fields['F'] != "postmaster.c" {
+		t.Errorf("expected all fields to be parsed: %#v", pgErr.Fields)
+	}
+	expected := "FATAL: the database system is starting up (SQLSTATE 57P03); detail: some detail"
+	if pgErr.Error() != expected {
+		t.Errorf("Error()=%#v; expected %#v", pgErr.Error(), expected)
+	}
+
+	for _, invalid := range []string{"", "Cnot terminated", "C57P03\x00"} {
+		_, err = ParseError([]byte(invalid))
+		if err == nil {
+			t.Errorf("ParseError(%#v) must return an error", invalid)
+		}
+	}
+}
+
+func TestMD5Password(t *testing.T) {
+	output := md5Password("user", "pencil", []byte{1, 2, 3, 4})
+	const expected = "md54376eb6913b38f9aaff38dc7cf19ca76"
+	if output != expected {
+		t.Errorf("md5Password()=%#v; expected %#v", output, expected)
+	}
+}
+
+func TestSCRAM(t *testing.T) {
+	// example from RFC 7677
+	scram := &scramClient{user: "user", password: "pencil", nonce: "rOprNGfwEbeRWgbNEkqO"}
+	clientFirst := scram.clientFirst()
+	if clientFirst != "n,,n=user,r=rOprNGfwEbeRWgbNEkqO" {
+		t.Errorf("unexpected clientFirst=%#v", clientFirst)
+	}
+
+	const serverFirst = "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0," +
+		"s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+	clientFinal, err := scram.clientFinal(serverFirst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const expectedFinal = "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0," +
+		"p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="
+	if clientFinal != expectedFinal {
+		t.Errorf("unexpected clientFinal=%#v", clientFinal)
+	}
+
+	err = scram.verifyServerFinal("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")
+	if err != nil {
+		t.Error(err)
+	}
+	err = scram.verifyServerFinal("v=AAAATRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")
+	if err == nil {
+		t.Error("verifyServerFinal must reject an invalid signature")
+	}
+
+	// the server nonce must start with the client nonce
+	_, err = scram.clientFinal("r=wrong,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")
+	if err == nil {
+		t.Error("clientFinal must reject an invalid nonce")
+	}
+}
+
+// fakeServer reads messages from the client and sends responses over a net.Pipe.
+type fakeServer struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (s *fakeServer) expect(msgType byte) []byte {
+	msg, err := ReadMessage(s.r)
+	if err != nil {
+		s.t.Error(err)
+		return nil
+	}
+	if msg.Type != msgType {
+		s.t.Errorf("expected message type=%q; was %q", msgType, msg.Type)
+	}
+	return msg.Body
+}
+
+func (s *fakeServer) send(msgType byte, body []byte) {
+	err := WriteMessage(s.conn, msgType, body)
+	if err != nil {
+		s.t.Error(err)
+	}
+}
+
+func int32Body(values ...uint32) []byte {
+	var body []byte
+	for _, v := range values {
+		body = binary.BigEndian.AppendUint32(body, v)
+	}
+	return body
+}
+
+func TestConnFakeServer(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+	defer serverConn.Close()
+	server := &fakeServer{t, serverConn, bufio.NewReader(serverConn)}
+
+	go func() {
+		// startup message: length, version, parameters
+		var header [8]byte
+		_, err := io.ReadFull(server.r, header[:])
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		params := make([]byte, binary.BigEndian.Uint32(header[:])-8)
+		_, err = io.ReadFull(server.r, params)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if !bytes.Equal(params, []byte("database\x00db\x00user\x00user\x00\x00")) {
+			t.Errorf("unexpected startup parameters: %#v", string(params))
+		}
+
+		server.send(msgAuthentication, int32Body(authCleartextPassword))
+		if password := server.expect(msgPassword); string(password) != "secret\x00" {
+			t.Errorf("unexpected password message: %#v", string(password))
+		}
+		server.send(msgAuthentication, int32Body(authOK))
+		server.send(msgParameterStatus, []byte("server_version\x0016.1\x00"))
+		server.send(msgBackendKeyData, int32Body(1234, 5678))
+		server.send(msgReadyForQuery, []byte("I"))
+
+		if query := server.expect(msgQuery); string(query) != "SELECT a, b\x00" {
+			t.Errorf("unexpected query: %#v", string(query))
+		}
+		rowDescription := []byte{0, 2}
+		for _, name := range []string{"a", "b"} {
+			rowDescription = appendString(rowDescription, name)
+			rowDescription = append(rowDescription, make([]byte, 18)...)
+		}
+		server.send(msgRowDescription, rowDescription)
+		// one value "x", and one NULL with length -1
+		server.send(msgDataRow, append([]byte{0, 2, 0, 0, 0, 1, 'x'}, int32Body(0xffffffff)...))
+		server.send(msgCommandComplete, []byte("SELECT 1\x00"))
+		server.send(msgReadyForQuery, []byte("I"))
+
+		server.expect(msgQuery)
+		server.send(msgErrorResponse, []byte("VERROR\x00C42601\x00Msyntax error\x00\x00"))
+		server.send(msgReadyForQuery, []byte("I"))
+
+		server.expect(msgTerminate)
+	}()
+
+	// replace Dial with the pipe
+	c := &Conn{clientConn, bufio.NewReader(clientConn), map[string]string{}, 0}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := c.withContext(ctx, func() error {
+		return c.startup(Config{User: "user", Password: "secret", Database: "db"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ParameterStatus("server_version") != "16.1" || c.ProcessID() != 1234 {
+		t.Errorf("unexpected server_version=%#v pid=%d",
+			c.ParameterStatus("server_version"), c.ProcessID())
+	}
+
+	results, err := c.SimpleQuery(ctx, "SELECT a, b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || len(results[0].Rows) != 1 {
+		t.Fatalf("unexpected results: %#v", results)
+	}
+	result := results[0]
+	if len(result.Columns) != 2 || result.Columns[1] != "b" || result.CommandTag != "SELECT 1" {
+		t.Errorf("unexpected result: %#v", result)
+	}
+	row := result.Rows[0]
+	if *row[0] != "x" || row[1] != nil {
+		t.Errorf("unexpected row: %#v", row)
+	}
+
+	_, err = c.SimpleQuery(ctx, "SELEC")
+	var pgErr *Error
+	if !(errors.As(err, &pgErr) && pgErr.Code == "42601") {
+		t.Errorf("expected syntax error; err=%v", err)
+	}
+
+	err = c.Close()
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestConnCancel(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	defer serverConn.Close()
+	c := &Conn{clientConn, bufio.NewReader(clientConn), map[string]string{}, 0}
+	defer c.Close()
+
+	// the server never responds
+	go func() {
+		server := &fakeServer{t, serverConn, bufio.NewReader(serverConn)}
+		server.expect(msgQuery)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := c.SimpleQuery(ctx, "SELECT 1")
+	if err != context.DeadlineExceeded {
+		t.Errorf("expected context.DeadlineExceeded; err=%v", err)
+	}
+}
@@ -0,0 +1,162 @@
+package pgwire
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/exp/slices"
+)
+
+// the only SASL mechanism supported by Postgres without channel binding
+const scramSHA256 = "SCRAM-SHA-256"
+
+// the GS2 header for a client that does not support channel binding; base64 encoded as "biws"
+const scramGS2Header = "n,,"
+
+// scramClient implements the client side of SCRAM-SHA-256 authentication. See:
+// https://www.postgresql.org/docs/current/sasl-authentication.html
+// https://datatracker.ietf.org/doc/html/rfc5802
+type scramClient struct {
+	user     string
+	password string
+	nonce    string
+
+	clientFirstBare string
+	// set by clientFinal
+	authMessage    string
+	saltedPassword []byte
+}
+
+func newSCRAMClient(user string, password string) (*scramClient, error) {
+	randomBytes := make([]byte, 18)
+	_, err := cryptorand.Read(randomBytes)
+	if err != nil {
+		return nil, err
+	}
+	return &scramClient{user: user, password: password,
+		nonce: base64.StdEncoding.EncodeToString(randomBytes)}, nil
+}
+
+// clientFirst returns the client-first-message. Postgres ignores the user name in it, and uses
+// the name from the startup message.
+func (s *scramClient) clientFirst() string {
+	// RFC 5802: "=" and "," in the user name must be escaped
+	user := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(s.user)
+	s.clientFirstBare = "n=" + user + ",r=" + s.nonce
+	return scramGS2Header + s.clientFirstBare
+}
+
+// clientFinal returns the client-final-message in response to serverFirst.
+func (s *scramClient) clientFinal(serverFirst string) (string, error) {
+	attributes := parseSCRAMAttributes(serverFirst)
+	serverNonce := attributes["r"]
+	if !strings.HasPrefix(serverNonce, s.nonce) || len(serverNonce) == len(s.nonce) {
+		return "", fmt.Errorf("pgwire: invalid SCRAM server nonce=%#v", serverNonce)
+	}
+	salt, err := base64.StdEncoding.DecodeString(attributes["s"])
+	if err != nil {
+		return "", fmt.Errorf("pgwire: invalid SCRAM salt: %w", err)
+	}
+	iterations, err := strconv.Atoi(attributes["i"])
+	if err != nil || iterations <= 0 {
+		return "", fmt.Errorf("pgwire: invalid SCRAM iterations=%#v", attributes["i"])
+	}
+
+	s.saltedPassword, err = pbkdf2.Key(sha256.New, s.password, salt, iterations, sha256.Size)
+	if err != nil {
+		return "", err
+	}
+	clientFinalWithoutProof := "c=" + base64.StdEncoding.EncodeToString([]byte(scramGS2Header)) +
+		",r=" + serverNonce
+	s.authMessage = s.clientFirstBare + "," + serverFirst + "," + clientFinalWithoutProof
+
+	clientKey := hmacSHA256(s.saltedPassword, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	clientSignature := hmacSHA256(storedKey[:], s.authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range proof {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+	return clientFinalWithoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+// verifyServerFinal checks that the server-final-message proves the server knows the password.
+func (s *scramClient) verifyServerFinal(serverFinal string) error {
+	if s.authMessage == "" {
+		return errors.New("pgwire: unexpected SCRAM server-final-message")
+	}
+	attributes := parseSCRAMAttributes(serverFinal)
+	if attributes["e"] != "" {
+		return fmt.Errorf("pgwire: SCRAM authentication failed: %s", attributes["e"])
+	}
+	signature, err := base64.StdEncoding.DecodeString(attributes["v"])
+	if err != nil {
+		return fmt.Errorf("pgwire: invalid SCRAM server signature: %w", err)
+	}
+	serverKey := hmacSHA256(s.saltedPassword, "Server Key")
+	if !hmac.Equal(signature, hmacSHA256(serverKey, s.authMessage)) {
+		return errors.New("pgwire: SCRAM server signature does not match")
+	}
+	return nil
+}
+
+func hmacSHA256(key []byte, message string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(message))
+	return h.Sum(nil)
+}
+
+// parseSCRAMAttributes parses a message in the form "a=value,b=value".
+func parseSCRAMAttributes(message string) map[string]string {
+	attributes := map[string]string{}
+	for _, attribute := range strings.Split(message, ",") {
+		key, value, found := strings.Cut(attribute, "=")
+		if found {
+			attributes[key] = value
+		}
+	}
+	return attributes
+}
+
+// startSCRAM handles an AuthenticationSASL request by sending the client-first-message.
+func (c *Conn) startSCRAM(config Config, mechanisms []byte) (*scramClient, error) {
+	supported := splitNullTerminated(mechanisms)
+	if !slices.Contains(supported, scramSHA256) {
+		return nil, fmt.Errorf("pgwire: unsupported SASL mechanisms=%q", supported)
+	}
+	if config.Password == "" {
+		return nil, errors.New("pgwire: server requested a password but Config.Password is empty")
+	}
+	scram, err := newSCRAMClient(config.User, config.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	// SASLInitialResponse: mechanism name, then the length-prefixed response
+	clientFirst := scram.clientFirst()
+	body := appendString(nil, scramSHA256)
+	body = binary.BigEndian.AppendUint32(body, uint32(len(clientFirst)))
+	body = append(body, clientFirst...)
+	return scram, WriteMessage(c.conn, msgPassword, body)
+}
+
+// continueSCRAM handles an AuthenticationSASLContinue request by sending the
+// client-final-message.
+func (c *Conn) continueSCRAM(scram *scramClient, serverFirst []byte) error {
+	if scram == nil {
+		return errors.New("pgwire: unexpected SASLContinue")
+	}
+	clientFinal, err := scram.clientFinal(string(serverFirst))
+	if err != nil {
+		return err
+	}
+	return WriteMessage(c.conn, msgPassword, []byte(clientFinal))
+}
@@ -0,0 +1,106 @@
+package pgxtxn
+
+import (
+	"context"
+	"sync"
+)
+
+// key for the *hooks in the ctx passed to the transaction body
+type hooksKey struct{}
+
+// hooks are the callbacks registered by one attempt to execute a transaction body.
+type hooks struct {
+	mu         sync.Mutex
+	onCommit   []func(ctx context.Context)
+	onRollback []func(ctx context.Context)
+	// OnRollback callbacks from savepoints that were rolled back: called whether the transaction
+	// commits or not
+	savepointRollbacks []func(ctx context.Context)
+}
+
+// withHooks returns a ctx with new hooks for an attempt.
+func withHooks(ctx context.Context) (context.Context, *hooks) {
+	h := &hooks{}
+	return context.WithValue(ctx, hooksKey{}, h), h
+}
+
+func hooksFromContext(ctx context.Context, funcName string) *hooks {
+	h, ok := ctx.Value(hooksKey{}).(*hooks)
+	if !ok {
+		panic("pgxtxn: " + funcName + " must be called with the ctx passed to a transaction body")
+	}
+	return h
+}
+
+// run calls the callbacks for rolled back savepoints, then the OnCommit or OnRollback callbacks,
+// in the order they were registered. It does nothing if h is nil.
+func (h *hooks) run(ctx context.Context, committed bool) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	callbacks := append([]func(ctx context.Context){}, h.savepointRollbacks...)
+	if committed {
+		callbacks = append(callbacks, h.onCommit...)
+	} else {
+		callbacks = append(callbacks, h.onRollback...)
+	}
+	h.mu.Unlock()
+	for _, f := range callbacks {
+		f(ctx)
+	}
+}
+
+// merge adds the callbacks registered in the savepoint child to h. If the savepoint was rolled
+// back, it discards child's OnCommit callbacks, and its OnRollback callbacks are called when h's
+// transaction finishes. It does nothing if h or child is nil.
+func (h *hooks) merge(child *hooks, rolledBack bool) {
+	if h == nil || child == nil {
+		return
+	}
+	child.mu.Lock()
+	onCommit := child.onCommit
+	onRollback := child.onRollback
+	savepointRollbacks := child.savepointRollbacks
+	child.mu.Unlock()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.savepointRollbacks = append(h.savepointRollbacks, savepointRollbacks...)
+	if rolledBack {
+		h.savepointRollbacks = append(h.savepointRollbacks, onRollback...)
+		return
+	}
+	h.onCommit = append(h.onCommit, onCommit...)
+	h.onRollback = append(h.onRollback, onRollback...)
+}
+
+// OnCommit registers f to be called after the transaction commits. The ctx argument must be the
+// ctx passed to the transaction body by Run or one of its variants. Callbacks registered by
+// attempts that are retried are discarded, so f is called at most once, even if the body is
+// executed multiple times. Callbacks are called in the order they were registered, with the ctx
+// passed to Run. It panics if ctx is not from a transaction body.
+//
+// This can implement the transactional outbox pattern: the body inserts a message into an outbox
+// table, and registers a callback that wakes up the process that publishes it. Messages are only
+// published if the transaction commits, and are not lost if the process exits after it commits.
+func OnCommit(ctx context.Context, f func(ctx context.Context)) {
+	h := hooksFromContext(ctx, "OnCommit")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.onCommit = append(h.onCommit, f)
+}
+
+// OnRollback registers f to be called if Run returns an error after the transaction body
+// executed, including when Commit fails. It is also called if the body passed to Run rolls back
+// the transaction itself and returns nil; in that case the OnCommit callbacks are not called. Like
+// OnCommit, only callbacks registered by the last attempt are called. If f is registered in a
+// savepoint that is rolled back (see Tx.Savepoint and nested calls to Run), f is called when the
+// outermost transaction finishes, whether it commits or not, unless that attempt is retried. It
+// panics if ctx is not from a transaction body.
+func OnRollback(ctx context.Context, f func(ctx context.Context)) {
+	h := hooksFromContext(ctx, "OnRollback")
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.onRollback = append(h.onRollback, f)
+}
@@ -0,0 +1,102 @@
+package pgxtxn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"golang.org/x/exp/slices"
+)
+
+func TestHooks(t *testing.T) {
+	ctx := context.Background()
+	serializationErr := &pgconn.PgError{Code: PGCodeSerializationFailure}
+	noDelay := Options{RetryPolicy: RetryPolicy{BaseDelay: -1}}
+
+	// only the hooks from the attempt that commits are called
+	var calls []string
+	attempt := 0
+	db := &fakeDB{commitErrs: []error{serializationErr}}
+	err := RunTx(ctx, db, func(ctx context.Context, tx Tx) error {
+		attempt++
+		name := fmt.Sprintf("attempt%d", attempt)
+		OnCommit(ctx, func(ctx context.Context) { calls = append(calls, "commit "+name) })
+		OnRollback(ctx, func(ctx context.Context) { calls = append(calls, "rollback "+name) })
+		OnCommit(ctx, func(ctx context.Context) { calls = append(calls, "commit2 "+name) })
+		return nil
+	}, noDelay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"commit attempt2", "commit2 attempt2"}
+	if !slices.Equal(calls, expected) {
+		t.Errorf("calls=%#v; expected %#v", calls, expected)
+	}
+
+	// only the rollback hooks from the last attempt are called if the transaction fails
+	calls = nil
+	attempt = 0
+	err = RunTx(ctx, &fakeDB{}, func(ctx context.Context, tx Tx) error {
+		attempt++
+		name := fmt.Sprintf("attempt%d", attempt)
+		OnCommit(ctx, func(ctx context.Context) { calls = append(calls, "commit "+name) })
+		OnRollback(ctx, func(ctx context.Context) { calls = append(calls, "rollback "+name) })
+		return serializationErr
+	}, noDelay)
+	if err != serializationErr {
+		t.Fatal(err)
+	}
+	expected = []string{"rollback attempt3"}
+	if !slices.Equal(calls, expected) {
+		t.Errorf("calls=%#v; expected %#v", calls, expected)
+	}
+
+	// failing to begin does not call hooks
+	err = RunTx(ctx, &fakeDB{beginErr: errors.New("begin error")},
+		func(ctx context.Context, tx Tx) error { return nil }, noDelay)
+	if err == nil || err.Error() != "begin error" {
+		t.Fatal(err)
+	}
+}
+
+func TestHooksPanicOutsideTransaction(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("OnCommit must panic when ctx is not from a transaction")
+		}
+	}()
+	OnCommit(context.Background(), func(ctx context.Context) {})
+}
+
+func TestHooksExplicitRollback(t *testing.T) {
+	ctx := context.Background()
+	var calls []string
+	err := Run(ctx, &fakeDB{}, func(ctx context.Context, tx pgx.Tx) error {
+		OnCommit(ctx, func(ctx context.Context) { calls = append(calls, "commit") })
+		OnRollback(ctx, func(ctx context.Context) { calls = append(calls, "rollback") })
+		return tx.Rollback(ctx)
+	}, pgx.TxOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(calls, []string{"rollback"}) {
+		t.Errorf("calls=%#v; expected only the rollback hook", calls)
+	}
+
+	// explicitly committing calls the commit hooks
+	calls = nil
+	err = Run(ctx, &fakeDB{}, func(ctx context.Context, tx pgx.Tx) error {
+		OnCommit(ctx, func(ctx context.Context) { calls = append(calls, "commit") })
+		OnRollback(ctx, func(ctx context.Context) { calls = append(calls, "rollback") })
+		return tx.Commit(ctx)
+	}, pgx.TxOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(calls, []string{"commit"}) {
+		t.Errorf("calls=%#v; expected only the commit hook", calls)
+	}
+}
@@ -0,0 +1,85 @@
+package pgxtxn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// key for the *enclosingTx in the ctx passed to the transaction body
+type enclosingTxKey struct{}
+
+// enclosingTx is the transaction executing a body, so Run can nest transactions.
+type enclosingTx struct {
+	db TransactionalDB
+	tx pgx.Tx
+}
+
+// withEnclosingTx returns a ctx for a body executed in tx started by db.
+func withEnclosingTx(ctx context.Context, db TransactionalDB, tx pgx.Tx) context.Context {
+	return context.WithValue(ctx, enclosingTxKey{}, &enclosingTx{db, tx})
+}
+
+// enclosingTxFromContext returns the transaction in ctx if it was started by db, or nil.
+func enclosingTxFromContext(ctx context.Context, db TransactionalDB) *enclosingTx {
+	enclosing, ok := ctx.Value(enclosingTxKey{}).(*enclosingTx)
+	if !ok || !sameDB(enclosing.db, db) {
+		return nil
+	}
+	return enclosing
+}
+
+// sameDB returns true if a and b are equal, without panicking if they are not comparable.
+func sameDB(a TransactionalDB, b TransactionalDB) bool {
+	aType := reflect.TypeOf(a)
+	return aType == reflect.TypeOf(b) && aType.Comparable() && a == b
+}
+
+// runNested executes body in a savepoint of tx, without retries. If body returns an error, it rolls
+// back to the savepoint and returns the error. The callbacks registered by body are added to the
+// enclosing transaction's if the savepoint is released. If it is rolled back, the OnCommit
+// callbacks are discarded, and the OnRollback callbacks are called when the outermost transaction
+// finishes.
+func runNested(
+	ctx context.Context, db TransactionalDB, tx pgx.Tx,
+	body func(ctx context.Context, tx pgx.Tx) error,
+) error {
+	// pgx implements Begin on a transaction with SAVEPOINT
+	dbSavepoint, err := tx.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	savepoint := &bodyTx{Tx: dbSavepoint}
+
+	// only create hooks if the enclosing transaction has them to merge with
+	bodyCtx := ctx
+	parentHooks, _ := ctx.Value(hooksKey{}).(*hooks)
+	var savepointHooks *hooks
+	if parentHooks != nil {
+		bodyCtx, savepointHooks = withHooks(ctx)
+	}
+	if db != nil {
+		bodyCtx = withEnclosingTx(bodyCtx, db, savepoint)
+	}
+
+	err = body(bodyCtx, savepoint)
+	if err != nil {
+		rollbackErr := savepoint.Rollback(ctx)
+		if rollbackErr != nil && rollbackErr != pgx.ErrTxClosed {
+			err = fmt.Errorf("%w; rolling back savepoint also failed: %w", err, rollbackErr)
+		}
+		parentHooks.merge(savepointHooks, true)
+		return err
+	}
+
+	// ErrTxClosed: body released or rolled back the savepoint itself
+	err = savepoint.Commit(ctx)
+	parentHooks.merge(savepointHooks, savepoint.rolledBack)
+	if err != nil && !errors.Is(err, pgx.ErrTxClosed) {
+		return err
+	}
+	return nil
+}
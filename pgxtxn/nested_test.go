@@ -0,0 +1,232 @@
+package pgxtxn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/evanj/hacks/postgrestest"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"golang.org/x/exp/slices"
+)
+
+func TestNestedRetriesOutermost(t *testing.T) {
+	ctx := context.Background()
+	serializationErr := &pgconn.PgError{Code: PGCodeSerializationFailure}
+	noDelay := Options{RetryPolicy: RetryPolicy{BaseDelay: -1}}
+	db := &fakeDB{}
+	otherDB := &fakeDB{}
+
+	outerCount := 0
+	innerCount := 0
+	err := RunTx(ctx, db, func(ctx context.Context, tx Tx) error {
+		outerCount++
+		err := RunTx(ctx, db, func(ctx context.Context, tx Tx) error {
+			innerCount++
+			if innerCount == 1 {
+				return serializationErr
+			}
+			return nil
+		}, noDelay)
+		if err != nil {
+			return err
+		}
+
+		// transactions with other databases are not nested
+		return RunTx(ctx, otherDB, func(ctx context.Context, tx Tx) error { return nil }, noDelay)
+	}, noDelay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if outerCount != 2 || innerCount != 2 || db.begins != 2 {
+		t.Errorf("expected only the outermost call to retry; outer=%d inner=%d begins=%d",
+			outerCount, innerCount, db.begins)
+	}
+	if otherDB.begins != 1 {
+		t.Errorf("expected otherDB to begin its own transaction; begins=%d", otherDB.begins)
+	}
+}
+
+func TestNestedHooks(t *testing.T) {
+	ctx := context.Background()
+	exampleErr := errors.New("example error")
+	db := &fakeDB{}
+
+	var calls []string
+	record := func(name string) func(ctx context.Context) {
+		return func(ctx context.Context) { calls = append(calls, name) }
+	}
+	err := RunTx(ctx, db, func(ctx context.Context, tx Tx) error {
+		OnCommit(ctx, record("outer commit"))
+		err := RunTx(ctx, db, func(ctx context.Context, tx Tx) error {
+			OnCommit(ctx, record("released commit"))
+			OnRollback(ctx, record("released rollback"))
+			return nil
+		}, Options{})
+		if err != nil {
+			return err
+		}
+
+		err = tx.Savepoint(ctx, func(ctx context.Context, tx Tx) error {
+			OnCommit(ctx, record("rolled back commit"))
+			OnRollback(ctx, record("rolled back rollback"))
+			return exampleErr
+		})
+		if err != exampleErr {
+			t.Errorf("expected exampleErr from savepoint; got %v", err)
+		}
+		return nil
+	}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"rolled back rollback", "outer commit", "released commit"}
+	if !slices.Equal(calls, expected) {
+		t.Errorf("calls=%#v; expected %#v", calls, expected)
+	}
+}
+
+func TestNestedPartialRollback(t *testing.T) {
+	pgURL := postgrestest.New(t)
+	ctx := context.Background()
+	pgPool, err := pgxpool.New(ctx, pgURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pgPool.Close()
+	_, err = pgPool.Exec(ctx, `CREATE TABLE example (value INTEGER NOT NULL PRIMARY KEY)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a library function that uses its own transaction
+	insert := func(ctx context.Context, value int) error {
+		return Run(ctx, pgPool, func(ctx context.Context, tx pgx.Tx) error {
+			_, err := tx.Exec(ctx, `INSERT INTO example VALUES ($1)`, value)
+			return err
+		}, pgx.TxOptions{})
+	}
+
+	exampleErr := errors.New("example error")
+	err = RunTx(ctx, pgPool, func(ctx context.Context, tx Tx) error {
+		err := insert(ctx, 1)
+		if err != nil {
+			return err
+		}
+		// the duplicate is rolled back, but the enclosing transaction continues
+		err = insert(ctx, 1)
+		var pgErr *pgconn.PgError
+		if !errors.As(err, &pgErr) || pgErr.Code != "23505" {
+			t.Errorf("expected unique violation; got %v", err)
+		}
+		return insert(ctx, 2)
+	}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rolling back the enclosing transaction rolls back the nested transactions
+	err = RunTx(ctx, pgPool, func(ctx context.Context, tx Tx) error {
+		err := insert(ctx, 3)
+		if err != nil {
+			return err
+		}
+		return exampleErr
+	}, Options{})
+	if err != exampleErr {
+		t.Fatal(err)
+	}
+
+	rows, err := pgPool.Query(ctx, `SELECT value FROM example ORDER BY value`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	values, err := pgx.CollectRows(rows, pgx.RowTo[int32])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(values, []int32{1, 2}) {
+		t.Errorf("expected values [1 2]; got %v", values)
+	}
+}
+
+func TestNestedRollbackHooksRunOnce(t *testing.T) {
+	ctx := context.Background()
+	exampleErr := errors.New("example error")
+	serializationErr := &pgconn.PgError{Code: PGCodeSerializationFailure}
+
+	// the outer attempt is retried after a savepoint rolled back: its hooks are discarded
+	var calls []string
+	db := &fakeDB{commitErrs: []error{serializationErr}}
+	attempt := 0
+	err := RunTx(ctx, db, func(ctx context.Context, tx Tx) error {
+		attempt++
+		err := tx.Savepoint(ctx, func(ctx context.Context, tx Tx) error {
+			OnRollback(ctx, func(ctx context.Context) {
+				calls = append(calls, fmt.Sprintf("savepoint rollback %d", attempt))
+			})
+			return exampleErr
+		})
+		if err != exampleErr {
+			t.Errorf("expected exampleErr from savepoint; got %v", err)
+		}
+		if len(calls) != 0 {
+			t.Error("savepoint OnRollback callbacks must not be called before the transaction finishes")
+		}
+		return nil
+	}, Options{RetryPolicy: RetryPolicy{BaseDelay: -1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"savepoint rollback 2"}
+	if !slices.Equal(calls, expected) {
+		t.Errorf("calls=%#v; expected %#v", calls, expected)
+	}
+
+	// the callbacks are also called if the outer transaction rolls back
+	calls = nil
+	err = RunTx(ctx, &fakeDB{}, func(ctx context.Context, tx Tx) error {
+		tx.Savepoint(ctx, func(ctx context.Context, tx Tx) error {
+			OnRollback(ctx, func(ctx context.Context) { calls = append(calls, "savepoint rollback") })
+			return exampleErr
+		})
+		OnRollback(ctx, func(ctx context.Context) { calls = append(calls, "outer rollback") })
+		return exampleErr
+	}, Options{})
+	if err != exampleErr {
+		t.Fatal(err)
+	}
+	expected = []string{"savepoint rollback", "outer rollback"}
+	if !slices.Equal(calls, expected) {
+		t.Errorf("calls=%#v; expected %#v", calls, expected)
+	}
+}
+
+func TestNestedBodyRollsBackSavepoint(t *testing.T) {
+	// the nested body rolls back its savepoint itself and returns nil
+	ctx := context.Background()
+	db := &fakeDB{}
+	var calls []string
+	err := Run(ctx, db, func(ctx context.Context, tx pgx.Tx) error {
+		err := Run(ctx, db, func(ctx context.Context, tx pgx.Tx) error {
+			OnCommit(ctx, func(ctx context.Context) { calls = append(calls, "savepoint commit") })
+			OnRollback(ctx, func(ctx context.Context) { calls = append(calls, "savepoint rollback") })
+			return tx.Rollback(ctx)
+		}, pgx.TxOptions{})
+		if err != nil {
+			t.Errorf("nested Run must return nil; got %v", err)
+		}
+		OnCommit(ctx, func(ctx context.Context) { calls = append(calls, "outer commit") })
+		return nil
+	}, pgx.TxOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"savepoint rollback", "outer commit"}
+	if !slices.Equal(calls, expected) {
+		t.Errorf("calls=%#v; expected %#v", calls, expected)
+	}
+}
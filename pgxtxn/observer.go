@@ -0,0 +1,204 @@
+package pgxtxn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/evanj/hacks/trivialstats"
+	"github.com/jackc/pgx/v5/pgconn"
+	"golang.org/x/exp/slog"
+)
+
+// EventType identifies the step of Run that an Event describes.
+type EventType int
+
+const (
+	// EventBegin is sent after TransactionalDB.BeginTx returns. Duration is how long it took.
+	EventBegin EventType = iota + 1
+	// EventAttempt is sent after the transaction body returns. Duration is how long it took.
+	EventAttempt
+	// EventCommit is sent after Commit returns. Duration is how long it took.
+	EventCommit
+	// EventRollback is sent after the transaction is rolled back because the body returned an
+	// error, which is reported by EventAttempt. Duration is how long the rollback took, and Err is
+	// the error from Rollback, or nil if it succeeded or the body already closed the transaction.
+	EventRollback
+	// EventRetry is sent before Run waits to retry. Duration is the delay before the next attempt,
+	// and Err is the error that is retried.
+	EventRetry
+	// EventDone is sent when Run returns. Duration is the time since Run started, Attempt is the
+	// number of attempts, and Err is the error returned by Run.
+	EventDone
+)
+
+func (e EventType) String() string {
+	switch e {
+	case EventBegin:
+		return "begin"
+	case EventAttempt:
+		return "attempt"
+	case EventCommit:
+		return "commit"
+	case EventRollback:
+		return "rollback"
+	case EventRetry:
+		return "retry"
+	case EventDone:
+		return "done"
+	default:
+		return fmt.Sprintf("EventType(%d)", int(e))
+	}
+}
+
+// Event describes one step of Run.
+type Event struct {
+	Type EventType
+	// The attempt number, starting at 1.
+	Attempt int
+	// See the documentation for each EventType.
+	Duration time.Duration
+	// The error from this step, or nil if it succeeded.
+	Err error
+}
+
+// SQLState returns the Postgres error code for Err, or the empty string if it is not a Postgres
+// error. See: https://www.postgresql.org/docs/current/errcodes-appendix.html
+func (e Event) SQLState() string {
+	var pgErr *pgconn.PgError
+	if errors.As(e.Err, &pgErr) {
+		return pgErr.Code
+	}
+	return ""
+}
+
+// Attrs returns slog attributes that describe the event.
+func (e Event) Attrs() []slog.Attr {
+	attrs := []slog.Attr{
+		slog.String("event", e.Type.String()),
+		slog.Int("attempt", e.Attempt),
+		slog.Duration("duration", e.Duration),
+	}
+	if e.Err != nil {
+		attrs = append(attrs, slog.String("error", e.Err.Error()))
+		if sqlState := e.SQLState(); sqlState != "" {
+			attrs = append(attrs, slog.String("sql_state", sqlState))
+		}
+	}
+	return attrs
+}
+
+// Observer receives events from Run, for example to record metrics or create tracing spans. The
+// ctx argument is the ctx passed to Run. Observe is called synchronously, so it should be fast.
+// It may be called concurrently by concurrent transactions.
+type Observer interface {
+	Observe(ctx context.Context, event Event)
+}
+
+// ObserverFunc adapts a function to the Observer interface.
+type ObserverFunc func(ctx context.Context, event Event)
+
+// Observe calls f(ctx, event).
+func (f ObserverFunc) Observe(ctx context.Context, event Event) {
+	f(ctx, event)
+}
+
+// observe sends event to observer. It does nothing if observer is nil.
+func observe(ctx context.Context, observer Observer, event Event) {
+	if observer != nil {
+		observer.Observe(ctx, event)
+	}
+}
+
+// StatsObserver is an Observer that records statistics about transactions, such as latency
+// percentiles and retry rates. It is safe to use concurrently.
+type StatsObserver struct {
+	mu                sync.Mutex
+	latency           *trivialstats.Distribution
+	attempts          *trivialstats.Distribution
+	transactions      int64
+	failed            int64
+	failedRollbacks   int64
+	retriesBySQLState map[string]int64
+}
+
+// NewStatsObserver returns a StatsObserver with no transactions.
+func NewStatsObserver() *StatsObserver {
+	return &StatsObserver{
+		latency:           trivialstats.NewDistribution(),
+		attempts:          trivialstats.NewDistribution(),
+		retriesBySQLState: map[string]int64{},
+	}
+}
+
+// Observe records event.
+func (s *StatsObserver) Observe(ctx context.Context, event Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch event.Type {
+	case EventRetry:
+		s.retriesBySQLState[event.SQLState()]++
+	case EventRollback:
+		if event.Err != nil {
+			s.failedRollbacks++
+		}
+	case EventDone:
+		s.latency.Add(event.Duration.Microseconds())
+		s.attempts.Add(int64(event.Attempt))
+		s.transactions++
+		if event.Err != nil {
+			s.failed++
+		}
+	}
+}
+
+// TransactionStats are the statistics recorded by StatsObserver.
+type TransactionStats struct {
+	// Number of calls to Run that returned.
+	Transactions int64
+	// Number of calls to Run that returned an error.
+	Failed int64
+	// Number of times rolling back a transaction returned an error.
+	FailedRollbacks int64
+	// Number of retries.
+	Retries int64
+	// Number of retries for each Postgres error code. Errors that are not Postgres errors use the
+	// empty string.
+	RetriesBySQLState map[string]int64
+	// The time Run took in microseconds, including retries. Zero if Transactions is 0.
+	Latency trivialstats.DistributionStats
+	// The number of attempts for each call to Run. Zero if Transactions is 0.
+	Attempts trivialstats.DistributionStats
+}
+
+// RetryRate returns the average number of retries for each transaction.
+func (t TransactionStats) RetryRate() float64 {
+	if t.Transactions == 0 {
+		return 0
+	}
+	return float64(t.Retries) / float64(t.Transactions)
+}
+
+// Stats returns the statistics for the transactions observed so far.
+func (s *StatsObserver) Stats() TransactionStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := TransactionStats{
+		Transactions:      s.transactions,
+		Failed:            s.failed,
+		FailedRollbacks:   s.failedRollbacks,
+		RetriesBySQLState: make(map[string]int64, len(s.retriesBySQLState)),
+	}
+	for sqlState, count := range s.retriesBySQLState {
+		stats.Retries += count
+		stats.RetriesBySQLState[sqlState] = count
+	}
+	// Distribution.Stats panics if there are no samples
+	if s.transactions > 0 {
+		stats.Latency = s.latency.Stats()
+		stats.Attempts = s.attempts.Stats()
+	}
+	return stats
+}
@@ -0,0 +1,115 @@
+package pgxtxn
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"golang.org/x/exp/slices"
+)
+
+func TestObserverEvents(t *testing.T) {
+	ctx := context.Background()
+	exampleErr := errors.New("example error")
+	var events []string
+	observer := ObserverFunc(func(ctx context.Context, event Event) {
+		events = append(events, event.Type.String()+" "+event.SQLState())
+	})
+
+	attempt := 0
+	db := &fakeDB{commitErrs: []error{&pgconn.PgError{Code: PGCodeSerializationFailure}}}
+	err := RunTx(ctx, db, func(ctx context.Context, tx Tx) error {
+		attempt++
+		if attempt == 2 {
+			return &pgconn.PgError{Code: PGCodeDeadlockDetected}
+		}
+		if attempt == 3 {
+			return exampleErr
+		}
+		return nil
+	}, Options{RetryPolicy: RetryPolicy{BaseDelay: -1}, Observer: observer})
+	if err != exampleErr {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"begin ", "attempt ", "commit 40001", "retry 40001",
+		"begin ", "attempt 40P01", "rollback ", "retry 40P01",
+		"begin ", "attempt ", "rollback ", "done ",
+	}
+	if !slices.Equal(events, expected) {
+		t.Errorf("events=%#v; expected %#v", events, expected)
+	}
+}
+
+func TestStatsObserver(t *testing.T) {
+	stats := NewStatsObserver()
+	empty := stats.Stats()
+	if empty.Transactions != 0 || empty.RetryRate() != 0 || empty.Latency.Count != 0 {
+		t.Errorf("unexpected stats with no transactions: %#v", empty)
+	}
+
+	ctx := context.Background()
+	options := Options{RetryPolicy: RetryPolicy{BaseDelay: -1}, Observer: stats}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			db := &fakeDB{commitErrs: []error{&pgconn.PgError{Code: PGCodeSerializationFailure}}}
+			err := RunTx(ctx, db, func(ctx context.Context, tx Tx) error { return nil }, options)
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	err := RunTx(ctx, &fakeDB{}, func(ctx context.Context, tx Tx) error {
+		return errors.New("example error")
+	}, options)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	s := stats.Stats()
+	if s.Transactions != 11 || s.Failed != 1 || s.Retries != 10 {
+		t.Errorf("unexpected stats: %#v", s)
+	}
+	if s.RetriesBySQLState[PGCodeSerializationFailure] != 10 {
+		t.Errorf("RetriesBySQLState=%#v; expected 10 serialization failures", s.RetriesBySQLState)
+	}
+	if s.Attempts.Max != 2 || s.Attempts.Min != 1 || s.Latency.Count != 11 {
+		t.Errorf("unexpected distributions: attempts=%s latency=%s", s.Attempts, s.Latency)
+	}
+	if s.RetryRate() != 10.0/11.0 {
+		t.Errorf("RetryRate()=%f", s.RetryRate())
+	}
+}
+
+func TestObserverRollbackError(t *testing.T) {
+	ctx := context.Background()
+	rollbackErr := errors.New("rollback error")
+	stats := NewStatsObserver()
+	var rollbackEvents []Event
+	observer := ObserverFunc(func(ctx context.Context, event Event) {
+		stats.Observe(ctx, event)
+		if event.Type == EventRollback {
+			rollbackEvents = append(rollbackEvents, event)
+		}
+	})
+
+	exampleErr := errors.New("example error")
+	err := RunTx(ctx, &fakeDB{rollbackErr: rollbackErr}, func(ctx context.Context, tx Tx) error {
+		return exampleErr
+	}, Options{Observer: observer})
+	if err != exampleErr {
+		t.Fatal(err)
+	}
+	if len(rollbackEvents) != 1 || rollbackEvents[0].Err != rollbackErr {
+		t.Errorf("expected one rollback event with the rollback error: %#v", rollbackEvents)
+	}
+	if stats.Stats().FailedRollbacks != 1 {
+		t.Errorf("FailedRollbacks=%d; expected 1", stats.Stats().FailedRollbacks)
+	}
+}
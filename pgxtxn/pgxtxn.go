@@ -4,14 +4,13 @@ package pgxtxn
 import (
 	"context"
 	"errors"
+	"fmt"
+	"time"
 
 	"github.com/jackc/pgx/v5"
-	"github.com/jackc/pgx/v5/pgconn"
 	"golang.org/x/exp/slog"
 )
 
-const maxRetries = 3
-
 // PGCodeDeadlockDetected is the Postgres error code for a deadlock. See:
 // https://www.postgresql.org/docs/current/errcodes-appendix.html
 const PGCodeDeadlockDetected = "40P01"
@@ -26,59 +25,159 @@ type TransactionalDB interface {
 	BeginTx(ctx context.Context, txOptions pgx.TxOptions) (pgx.Tx, error)
 }
 
+// Options configures RunWithOptions.
+type Options struct {
+	// Options passed to TransactionalDB.BeginTx.
+	TxOptions pgx.TxOptions
+	// Configures how failed transactions are retried.
+	RetryPolicy RetryPolicy
+	// If not nil, receives events for each step of the transaction.
+	Observer Observer
+}
+
 // Run executes body in a transaction that will always commit or roll back,
 // and with retries in case of deadlocks or serialization errors. If body returns an error, the
 // transaction is rolled back. If it returns nil, the transaction is committed. The body function
-// should not call Commit, but may call Rollback. The ctx argument is passed to Begin, Commit,
-// Rollback and body without modification.
+// should not call Commit, but may call Rollback. The ctx argument is passed to Begin, Commit and
+// Rollback without modification. The body gets a ctx derived from it that can register callbacks
+// with OnCommit and OnRollback. If body calls Rollback then returns nil, Run returns nil and calls
+// the OnRollback callbacks. It uses the default RetryPolicy.
+//
+// If ctx is from the body of a transaction started with the same db, Run executes body in a
+// SAVEPOINT in that transaction, so functions that use Run can be composed. If body returns an
+// error, only the changes it made are rolled back, and the error is returned to the enclosing
+// body. Nested calls are not retried and ignore txOptions: if the error is retryable and the
+// enclosing body returns it, the outermost call retries the whole transaction.
 //
 // This prevents the following common mistakes:
 // - Forgetting to COMMIT or ROLLBACK in all cases, leaving "stuck" transactions
 // - Forgetting to retry on serialization errors
 //
-// TODO: Pass an interface that does not have Commit to body to avoid mistakes?
+// RunTx and RunValue are safer: they pass body an interface that does not have Commit.
 func Run(
 	ctx context.Context, db TransactionalDB, body func(ctx context.Context, tx pgx.Tx) error,
 	txOptions pgx.TxOptions,
 ) error {
+	return RunWithOptions(ctx, db, body, Options{TxOptions: txOptions})
+}
 
-	for i := 0; i < maxRetries; i++ {
-		tx, err := db.BeginTx(ctx, txOptions)
-		if err != nil {
-			return err
+// RunWithOptions is Run with retries configured by options.RetryPolicy. It waits between
+// attempts with exponential backoff. If ctx is done while waiting, it returns an error that wraps
+// both ctx.Err() and the error from the last attempt.
+func RunWithOptions(
+	ctx context.Context, db TransactionalDB, body func(ctx context.Context, tx pgx.Tx) error,
+	options Options,
+) error {
+	if enclosing := enclosingTxFromContext(ctx, db); enclosing != nil {
+		return runNested(ctx, db, enclosing.tx, body)
+	}
+
+	policy := &options.RetryPolicy
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		attemptHooks, committed, err := runAttempt(ctx, db, body, options, attempt)
+		if err == nil {
+			observe(ctx, options.Observer,
+				Event{Type: EventDone, Attempt: attempt, Duration: time.Since(start)})
+			attemptHooks.run(ctx, committed)
+			return nil
 		}
-		err = body(ctx, tx)
-		if err != nil {
-			// ErrTxClosed happens if the transaction is already committed/rolled back explicitly
-			// but log any other errors (they should not happen)
-			err2 := tx.Rollback(ctx)
-			if err2 != nil && err2 != pgx.ErrTxClosed {
-				slog.LogAttrs(ctx, slog.LevelWarn, "pgtxn.Run: unexpected error when rolling back transaction while handling error",
-					slog.Int("attempt", i+1),
-					slog.String("rollback_error", err2.Error()),
-					slog.String("body_error", err.Error()),
-				)
-			}
-			var pgErr *pgconn.PgError
-			if errors.As(err, &pgErr) &&
-				(pgErr.Code == PGCodeDeadlockDetected || pgErr.Code == PGCodeSerializationFailure) {
-				if i == maxRetries-1 {
-					return err
-				}
 
+		// the hooks registered by attempts that are retried are discarded
+		if attempt < policy.maxAttempts() && policy.retryable(err, options.TxOptions) {
+			delay := policy.backoff(attempt)
+			if policy.canRetry(ctx, start, delay) {
+				retryEvent := Event{Type: EventRetry, Attempt: attempt, Duration: delay, Err: err}
+				observe(ctx, options.Observer, retryEvent)
 				slog.LogAttrs(ctx, slog.LevelInfo, "pgtxn.Run: retrying transaction",
-					slog.Int("attempt", i+1), slog.String("pg_error", pgErr.Error()))
-				continue
+					retryEvent.Attrs()...)
+				ctxErr := sleep(ctx, delay)
+				if ctxErr == nil {
+					continue
+				}
+				err = fmt.Errorf("pgxtxn: retry interrupted: %w; last attempt failed: %w", ctxErr, err)
 			}
-			return err
 		}
+		observe(ctx, options.Observer,
+			Event{Type: EventDone, Attempt: attempt, Duration: time.Since(start), Err: err})
+		attemptHooks.run(ctx, false)
+		return err
+	}
+}
 
-		err = tx.Commit(ctx)
-		if err != nil && errors.Is(err, pgx.ErrTxClosed) {
-			// this transaction was committed or rolled back explicitly: not an error
-			err = nil
+// bodyTx is the pgx.Tx passed to the body by Run. It records if the body closed the transaction
+// without committing it.
+type bodyTx struct {
+	pgx.Tx
+	rolledBack bool
+}
+
+func (t *bodyTx) Commit(ctx context.Context) error {
+	err := t.Tx.Commit(ctx)
+	if err != nil && !errors.Is(err, pgx.ErrTxClosed) {
+		// a failed commit rolls back
+		t.rolledBack = true
+	}
+	return err
+}
+
+func (t *bodyTx) Rollback(ctx context.Context) error {
+	err := t.Tx.Rollback(ctx)
+	if !errors.Is(err, pgx.ErrTxClosed) {
+		t.rolledBack = true
+	}
+	return err
+}
+
+// runAttempt executes body in a single transaction. It returns the hooks registered by body, or
+// nil if body was not executed. It returns committed=false with a nil error if the body rolled
+// back the transaction itself.
+func runAttempt(
+	ctx context.Context, db TransactionalDB, body func(ctx context.Context, tx pgx.Tx) error,
+	options Options, attempt int,
+) (attemptHooks *hooks, committed bool, err error) {
+	stepStart := time.Now()
+	dbTx, err := db.BeginTx(ctx, options.TxOptions)
+	observe(ctx, options.Observer,
+		Event{Type: EventBegin, Attempt: attempt, Duration: time.Since(stepStart), Err: err})
+	if err != nil {
+		return nil, false, err
+	}
+	tx := &bodyTx{Tx: dbTx}
+
+	bodyCtx, attemptHooks := withHooks(ctx)
+	bodyCtx = withEnclosingTx(bodyCtx, db, tx)
+	stepStart = time.Now()
+	err = body(bodyCtx, tx)
+	observe(ctx, options.Observer,
+		Event{Type: EventAttempt, Attempt: attempt, Duration: time.Since(stepStart), Err: err})
+	if err != nil {
+		// ErrTxClosed happens if the transaction is already committed/rolled back explicitly
+		// but log any other errors (they should not happen)
+		stepStart = time.Now()
+		err2 := tx.Rollback(ctx)
+		if err2 == pgx.ErrTxClosed {
+			err2 = nil
 		}
-		return err
+		observe(ctx, options.Observer,
+			Event{Type: EventRollback, Attempt: attempt, Duration: time.Since(stepStart), Err: err2})
+		if err2 != nil {
+			slog.LogAttrs(ctx, slog.LevelWarn, "pgtxn.Run: unexpected error when rolling back transaction while handling error",
+				slog.Int("attempt", attempt),
+				slog.String("rollback_error", err2.Error()),
+				slog.String("body_error", err.Error()),
+			)
+		}
+		return attemptHooks, false, err
+	}
+
+	stepStart = time.Now()
+	err = tx.Commit(ctx)
+	if err != nil && errors.Is(err, pgx.ErrTxClosed) {
+		// this transaction was committed or rolled back explicitly: not an error
+		err = nil
 	}
-	panic("BUG: should not be possible")
+	observe(ctx, options.Observer,
+		Event{Type: EventCommit, Attempt: attempt, Duration: time.Since(stepStart), Err: err})
+	return attemptHooks, err == nil && !tx.rolledBack, err
 }
@@ -0,0 +1,279 @@
+// Package pgxtxntest tests that transaction bodies are safe to retry, by injecting serialization
+// failures and deadlocks into transactions executed by pgxtxn.
+package pgxtxntest
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/evanj/hacks/pgxtxn"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Postgres error code for statements executed after an error aborted the transaction.
+const pgCodeInFailedTransaction = "25P02"
+
+// Fault is an error injected into one attempt to execute a transaction.
+type Fault struct {
+	// The attempt to inject into, starting at 1. Each call to BeginTx is an attempt.
+	Attempt int
+	// The Postgres error code to return. If empty, the default is
+	// pgxtxn.PGCodeSerializationFailure.
+	Code string
+	// If true, Commit rolls back and returns the error. Otherwise, the statement executed after
+	// AfterStatements statements returns the error, without being executed.
+	AtCommit bool
+	// The number of statements that succeed before the error, if AtCommit is false. Creating a
+	// savepoint counts as a statement.
+	AfterStatements int
+}
+
+func (f *Fault) err() *pgconn.PgError {
+	code := f.Code
+	if code == "" {
+		code = pgxtxn.PGCodeSerializationFailure
+	}
+	return &pgconn.PgError{
+		Severity: "ERROR",
+		Code:     code,
+		Message:  fmt.Sprintf("pgxtxntest: injected error for attempt %d", f.Attempt),
+	}
+}
+
+// ConflictDB is a pgxtxn.TransactionalDB that wraps another, and injects Faults into the
+// transactions it begins. It counts attempts across all transactions, so it should only be used
+// by one call to pgxtxn.Run at a time.
+type ConflictDB struct {
+	db     pgxtxn.TransactionalDB
+	faults []Fault
+
+	mu       sync.Mutex
+	attempts int
+}
+
+// NewConflictDB returns a ConflictDB that begins transactions with db and injects faults.
+func NewConflictDB(db pgxtxn.TransactionalDB, faults ...Fault) *ConflictDB {
+	return &ConflictDB{db: db, faults: faults}
+}
+
+// Attempts returns the number of times BeginTx was called.
+func (c *ConflictDB) Attempts() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.attempts
+}
+
+// BeginTx begins a transaction with the wrapped db that injects the Fault for this attempt.
+func (c *ConflictDB) BeginTx(ctx context.Context, txOptions pgx.TxOptions) (pgx.Tx, error) {
+	c.mu.Lock()
+	c.attempts++
+	attempt := c.attempts
+	c.mu.Unlock()
+
+	tx, err := c.db.BeginTx(ctx, txOptions)
+	if err != nil {
+		return nil, err
+	}
+	state := &attemptState{}
+	for i := range c.faults {
+		if c.faults[i].Attempt == attempt {
+			state.fault = &c.faults[i]
+			break
+		}
+	}
+	return &conflictTx{tx, state, false}, nil
+}
+
+// attemptState is shared by a transaction and its savepoints.
+type attemptState struct {
+	fault      *Fault
+	statements int
+	// the error that aborted the transaction, if any
+	abortErr error
+}
+
+// conflictTx injects an attemptState's fault.
+type conflictTx struct {
+	pgx.Tx
+	state  *attemptState
+	nested bool
+}
+
+// statementErr returns an error if the next statement must fail.
+func (t *conflictTx) statementErr() error {
+	s := t.state
+	if s.abortErr != nil {
+		return &pgconn.PgError{
+			Severity: "ERROR",
+			Code:     pgCodeInFailedTransaction,
+			Message:  "current transaction is aborted, commands ignored until end of transaction block",
+		}
+	}
+	if s.fault != nil && !s.fault.AtCommit && s.statements == s.fault.AfterStatements {
+		s.abortErr = s.fault.err()
+		s.fault = nil
+		return s.abortErr
+	}
+	s.statements++
+	return nil
+}
+
+func (t *conflictTx) Begin(ctx context.Context) (pgx.Tx, error) {
+	err := t.statementErr()
+	if err != nil {
+		return nil, err
+	}
+	savepoint, err := t.Tx.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &conflictTx{savepoint, t.state, true}, nil
+}
+
+func (t *conflictTx) Exec(
+	ctx context.Context, sql string, arguments ...any,
+) (pgconn.CommandTag, error) {
+	err := t.statementErr()
+	if err != nil {
+		return pgconn.CommandTag{}, err
+	}
+	return t.Tx.Exec(ctx, sql, arguments...)
+}
+
+func (t *conflictTx) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	err := t.statementErr()
+	if err != nil {
+		return &errRows{err: err}, err
+	}
+	return t.Tx.Query(ctx, sql, args...)
+}
+
+func (t *conflictTx) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	err := t.statementErr()
+	if err != nil {
+		return &errRows{err: err}
+	}
+	return t.Tx.QueryRow(ctx, sql, args...)
+}
+
+func (t *conflictTx) CopyFrom(
+	ctx context.Context, tableName pgx.Identifier, columnNames []string, rowSrc pgx.CopyFromSource,
+) (int64, error) {
+	err := t.statementErr()
+	if err != nil {
+		return 0, err
+	}
+	return t.Tx.CopyFrom(ctx, tableName, columnNames, rowSrc)
+}
+
+func (t *conflictTx) SendBatch(ctx context.Context, b *pgx.Batch) pgx.BatchResults {
+	err := t.statementErr()
+	if err != nil {
+		return &errBatchResults{err}
+	}
+	return t.Tx.SendBatch(ctx, b)
+}
+
+func (t *conflictTx) Commit(ctx context.Context) error {
+	if t.nested {
+		// releasing a savepoint
+		if t.state.abortErr != nil {
+			return t.statementErr()
+		}
+		return t.Tx.Commit(ctx)
+	}
+
+	s := t.state
+	if s.abortErr != nil {
+		// like Postgres, committing an aborted transaction rolls back
+		err := t.Tx.Rollback(ctx)
+		if err != nil {
+			return err
+		}
+		return pgx.ErrTxCommitRollback
+	}
+	if s.fault != nil && s.fault.AtCommit {
+		err := t.Tx.Rollback(ctx)
+		if err != nil {
+			return err
+		}
+		return s.fault.err()
+	}
+	return t.Tx.Commit(ctx)
+}
+
+func (t *conflictTx) Rollback(ctx context.Context) error {
+	if t.nested {
+		// rolling back to a savepoint recovers from an error, like Postgres
+		t.state.abortErr = nil
+	}
+	return t.Tx.Rollback(ctx)
+}
+
+// errRows is a pgx.Rows and pgx.Row that returns err.
+type errRows struct {
+	err error
+}
+
+func (r *errRows) Close()                                       {}
+func (r *errRows) Err() error                                   { return r.err }
+func (r *errRows) CommandTag() pgconn.CommandTag                { return pgconn.CommandTag{} }
+func (r *errRows) FieldDescriptions() []pgconn.FieldDescription { return nil }
+func (r *errRows) Next() bool                                   { return false }
+func (r *errRows) Scan(dest ...any) error                       { return r.err }
+func (r *errRows) Values() ([]any, error)                       { return nil, r.err }
+func (r *errRows) RawValues() [][]byte                          { return nil }
+func (r *errRows) Conn() *pgx.Conn                              { return nil }
+
+// errBatchResults is a pgx.BatchResults that returns err.
+type errBatchResults struct {
+	err error
+}
+
+func (b *errBatchResults) Exec() (pgconn.CommandTag, error) { return pgconn.CommandTag{}, b.err }
+func (b *errBatchResults) Query() (pgx.Rows, error)         { return &errRows{b.err}, b.err }
+func (b *errBatchResults) QueryRow() pgx.Row                { return &errRows{b.err} }
+func (b *errBatchResults) Close() error                     { return b.err }
+
+// CheckRetrySafe executes body with pgxtxn.RunTx, and injects a serialization failure when the
+// first attempt commits, so the body is executed twice. It calls state before the first attempt
+// and before the retry, and fails the test if the results are not equal with reflect.DeepEqual.
+// This means the failed attempt had effects outside the transaction, such as sending a message
+// or changing a variable, which happen again when it is retried. Callbacks registered with
+// pgxtxn.OnCommit are safe. It also fails the test if RunTx returns an error.
+func CheckRetrySafe(
+	t testing.TB, db pgxtxn.TransactionalDB, body func(ctx context.Context, tx pgxtxn.Tx) error,
+	state func() any,
+) {
+	t.Helper()
+	conflictDB := NewConflictDB(db, Fault{Attempt: 1, AtCommit: true})
+	before := state()
+	var afterFailure any
+	observer := pgxtxn.ObserverFunc(func(ctx context.Context, event pgxtxn.Event) {
+		if event.Type == pgxtxn.EventRetry && event.Attempt == 1 {
+			afterFailure = state()
+		}
+	})
+
+	err := pgxtxn.RunTx(context.Background(), conflictDB, body, pgxtxn.Options{
+		RetryPolicy: pgxtxn.RetryPolicy{BaseDelay: -1},
+		Observer:    observer,
+	})
+	if err != nil {
+		t.Errorf("pgxtxntest: transaction failed: %s", err.Error())
+		return
+	}
+	if conflictDB.Attempts() != 2 {
+		t.Errorf("pgxtxntest: expected the transaction to be retried once; attempts=%d",
+			conflictDB.Attempts())
+		return
+	}
+	if !reflect.DeepEqual(before, afterFailure) {
+		t.Errorf("pgxtxntest: transaction body is not safe to retry: a failed attempt changed "+
+			"state from %#v to %#v", before, afterFailure)
+	}
+}
@@ -0,0 +1,188 @@
+package pgxtxntest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/evanj/hacks/pgxtxn"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// fakeDB records the statements executed by committed transactions.
+type fakeDB struct {
+	committed []string
+}
+
+func (f *fakeDB) BeginTx(ctx context.Context, txOptions pgx.TxOptions) (pgx.Tx, error) {
+	return &fakeTx{db: f}, nil
+}
+
+// fakeTx only supports Exec, Begin, Commit and Rollback.
+type fakeTx struct {
+	pgx.Tx
+	db         *fakeDB
+	parent     *fakeTx
+	statements []string
+	closed     bool
+}
+
+func (f *fakeTx) Exec(
+	ctx context.Context, sql string, arguments ...any,
+) (pgconn.CommandTag, error) {
+	f.statements = append(f.statements, sql)
+	return pgconn.CommandTag{}, nil
+}
+
+func (f *fakeTx) Begin(ctx context.Context) (pgx.Tx, error) {
+	return &fakeTx{db: f.db, parent: f}, nil
+}
+
+func (f *fakeTx) Commit(ctx context.Context) error {
+	if f.closed {
+		return pgx.ErrTxClosed
+	}
+	f.closed = true
+	if f.parent != nil {
+		f.parent.statements = append(f.parent.statements, f.statements...)
+	} else {
+		f.db.committed = append(f.db.committed, f.statements...)
+	}
+	return nil
+}
+
+func (f *fakeTx) Rollback(ctx context.Context) error {
+	if f.closed {
+		return pgx.ErrTxClosed
+	}
+	f.closed = true
+	return nil
+}
+
+func pgCode(err error) string {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		return pgErr.Code
+	}
+	return ""
+}
+
+func TestConflictDBAfterStatements(t *testing.T) {
+	ctx := context.Background()
+	db := &fakeDB{}
+	conflictDB := NewConflictDB(db, Fault{Attempt: 1, AfterStatements: 1})
+
+	var errs []string
+	err := pgxtxn.RunTx(ctx, conflictDB, func(ctx context.Context, tx pgxtxn.Tx) error {
+		var bodyErr error
+		for i := 0; i < 3; i++ {
+			_, err := tx.Exec(ctx, fmt.Sprintf("statement %d", i))
+			errs = append(errs, pgCode(err))
+			if bodyErr == nil {
+				bodyErr = err
+			}
+		}
+		return bodyErr
+	}, pgxtxn.Options{RetryPolicy: pgxtxn.RetryPolicy{BaseDelay: -1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conflictDB.Attempts() != 2 {
+		t.Errorf("Attempts()=%d; expected 2", conflictDB.Attempts())
+	}
+	expected := "|40001|25P02|||"
+	if strings.Join(errs, "|") != expected {
+		t.Errorf("errs=%#v; expected %#v", strings.Join(errs, "|"), expected)
+	}
+	if strings.Join(db.committed, ",") != "statement 0,statement 1,statement 2" {
+		t.Errorf("unexpected committed statements: %#v", db.committed)
+	}
+}
+
+func TestConflictDBAtCommit(t *testing.T) {
+	ctx := context.Background()
+	db := &fakeDB{}
+	conflictDB := NewConflictDB(db,
+		Fault{Attempt: 1, AtCommit: true, Code: pgxtxn.PGCodeDeadlockDetected},
+		Fault{Attempt: 2, AtCommit: true},
+	)
+	err := pgxtxn.RunTx(ctx, conflictDB, func(ctx context.Context, tx pgxtxn.Tx) error {
+		_, err := tx.Exec(ctx, "statement")
+		return err
+	}, pgxtxn.Options{RetryPolicy: pgxtxn.RetryPolicy{BaseDelay: -1, MaxAttempts: 2}})
+	if pgCode(err) != pgxtxn.PGCodeSerializationFailure {
+		t.Errorf("expected serialization failure from the second attempt; err=%v", err)
+	}
+	if len(db.committed) != 0 {
+		t.Errorf("expected no committed statements: %#v", db.committed)
+	}
+
+	// rolling back a savepoint recovers from the injected error
+	conflictDB = NewConflictDB(db, Fault{Attempt: 1, AfterStatements: 1})
+	err = pgxtxn.RunTx(ctx, conflictDB, func(ctx context.Context, tx pgxtxn.Tx) error {
+		err := tx.Savepoint(ctx, func(ctx context.Context, tx pgxtxn.Tx) error {
+			_, err := tx.Exec(ctx, "statement in savepoint")
+			return err
+		})
+		if pgCode(err) != pgxtxn.PGCodeSerializationFailure {
+			t.Errorf("expected serialization failure from the savepoint; err=%v", err)
+		}
+		_, err = tx.Exec(ctx, "statement after savepoint")
+		return err
+	}, pgxtxn.Options{RetryPolicy: pgxtxn.RetryPolicy{MaxAttempts: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(db.committed, ",") != "statement after savepoint" {
+		t.Errorf("unexpected committed statements: %#v", db.committed)
+	}
+}
+
+// recordingTB records errors instead of failing the test.
+type recordingTB struct {
+	testing.TB
+	errors []string
+}
+
+func (r *recordingTB) Helper() {}
+
+func (r *recordingTB) Errorf(format string, args ...any) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func TestCheckRetrySafe(t *testing.T) {
+	// side effects registered with OnCommit are safe
+	published := 0
+	safeBody := func(ctx context.Context, tx pgxtxn.Tx) error {
+		_, err := tx.Exec(ctx, "INSERT INTO outbox VALUES ('message')")
+		if err != nil {
+			return err
+		}
+		pgxtxn.OnCommit(ctx, func(ctx context.Context) { published++ })
+		return nil
+	}
+	tb := &recordingTB{TB: t}
+	CheckRetrySafe(tb, &fakeDB{}, safeBody, func() any { return published })
+	if len(tb.errors) != 0 {
+		t.Errorf("safe body must not be flagged: %#v", tb.errors)
+	}
+	if published != 1 {
+		t.Errorf("published=%d; expected 1", published)
+	}
+
+	// side effects in the body are flagged
+	published = 0
+	unsafeBody := func(ctx context.Context, tx pgxtxn.Tx) error {
+		_, err := tx.Exec(ctx, "INSERT INTO outbox VALUES ('message')")
+		published++
+		return err
+	}
+	tb = &recordingTB{TB: t}
+	CheckRetrySafe(tb, &fakeDB{}, unsafeBody, func() any { return published })
+	if len(tb.errors) != 1 || !strings.Contains(tb.errors[0], "not safe to retry") {
+		t.Errorf("unsafe body must be flagged: %#v", tb.errors)
+	}
+}
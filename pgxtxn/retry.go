@@ -0,0 +1,132 @@
+package pgxtxn
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// default for RetryPolicy.MaxAttempts
+const defaultMaxAttempts = 3
+
+// default for RetryPolicy.BaseDelay
+const defaultBaseDelay = 10 * time.Millisecond
+
+// default for RetryPolicy.MaxDelay
+const defaultMaxDelay = time.Second
+
+// RetryPolicy configures how Run retries transactions that fail with retryable errors. The zero
+// value uses the defaults.
+type RetryPolicy struct {
+	// Maximum number of times the transaction is attempted, including the first. If 0, the default
+	// is 3. Set to 1 to disable retries.
+	MaxAttempts int
+
+	// Maximum delay before the first retry, which doubles with each retry up to MaxDelay. Each
+	// delay is chosen uniformly at random between zero and the maximum ("full jitter"), so
+	// conflicting transactions are unlikely to conflict again. If 0, the default is 10
+	// milliseconds. If negative, retries are not delayed.
+	BaseDelay time.Duration
+
+	// Maximum delay between two attempts. If 0, the default is 1 second.
+	MaxDelay time.Duration
+
+	// If not 0, Run does not retry if the next attempt would start this long after the first
+	// attempt started. Run also does not retry if the next attempt would start after ctx's deadline.
+	MaxElapsed time.Duration
+
+	// Retryable returns true if a transaction that failed with err should be retried. It is
+	// called with errors from Begin, body, and Commit. If nil, the default is IsRetryable, and
+	// also IsConnectionError for read-only transactions, since they cannot have effects that
+	// happen twice.
+	// Errors from Commit are ambiguous: the transaction may have committed. Only return true for
+	// errors where Postgres guarantees it rolled back, or if the transaction is idempotent.
+	Retryable func(err error) bool
+}
+
+// IsRetryable returns true if err is a Postgres deadlock or serialization failure. Postgres rolls
+// back the transaction for these errors, so retrying it is always safe. It is the default
+// RetryPolicy.Retryable. Callers can combine it with other checks, for example:
+//
+//	func(err error) bool { return pgxtxn.IsRetryable(err) || pgconn.SafeToRetry(err) }
+func IsRetryable(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) &&
+		(pgErr.Code == PGCodeDeadlockDetected || pgErr.Code == PGCodeSerializationFailure)
+}
+
+func (p *RetryPolicy) maxAttempts() int {
+	if p.MaxAttempts == 0 {
+		return defaultMaxAttempts
+	}
+	return p.MaxAttempts
+}
+
+func (p *RetryPolicy) retryable(err error, txOptions pgx.TxOptions) bool {
+	if p.Retryable == nil {
+		return IsRetryable(err) || (txOptions.AccessMode == pgx.ReadOnly && IsConnectionError(err))
+	}
+	return p.Retryable(err)
+}
+
+// maxBackoff returns the maximum delay after the attempt numbered attempt, starting at 1.
+func (p *RetryPolicy) maxBackoff(attempt int) time.Duration {
+	base := p.BaseDelay
+	if base == 0 {
+		base = defaultBaseDelay
+	}
+	if base < 0 {
+		return 0
+	}
+	maxDelay := p.MaxDelay
+	if maxDelay == 0 {
+		maxDelay = defaultMaxDelay
+	}
+
+	delay := base
+	for i := 1; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	return min(delay, maxDelay)
+}
+
+// backoff returns a random delay to wait after the attempt numbered attempt, starting at 1.
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	maxDelay := p.maxBackoff(attempt)
+	if maxDelay <= 0 {
+		return 0
+	}
+	return rand.N(maxDelay + 1)
+}
+
+// canRetry returns true if another attempt that starts after delay is permitted by MaxElapsed and
+// ctx's deadline.
+func (p *RetryPolicy) canRetry(ctx context.Context, start time.Time, delay time.Duration) bool {
+	next := time.Now().Add(delay)
+	if p.MaxElapsed != 0 && next.Sub(start) > p.MaxElapsed {
+		return false
+	}
+	if deadline, ok := ctx.Deadline(); ok && !next.Before(deadline) {
+		return false
+	}
+	return true
+}
+
+// sleep waits for delay, or until ctx is done. It returns ctx.Err() if ctx is done.
+func sleep(ctx context.Context, delay time.Duration) error {
+	if delay <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,201 @@
+package pgxtxn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// fakeTx is a pgx.Tx that only supports Begin, Commit and Rollback.
+type fakeTx struct {
+	pgx.Tx
+	commitErr   error
+	rollbackErr error
+	closed      bool
+}
+
+// Begin returns a fakeTx for a savepoint.
+func (f *fakeTx) Begin(ctx context.Context) (pgx.Tx, error) {
+	return &fakeTx{}, nil
+}
+
+func (f *fakeTx) Commit(ctx context.Context) error {
+	if f.closed {
+		return pgx.ErrTxClosed
+	}
+	f.closed = true
+	return f.commitErr
+}
+
+func (f *fakeTx) Rollback(ctx context.Context) error {
+	if f.closed {
+		return pgx.ErrTxClosed
+	}
+	f.closed = true
+	return f.rollbackErr
+}
+
+// fakeDB returns fakeTxs. Each Commit returns the next error in commitErrs. If beginErr is set,
+// BeginTx returns it. Rollback returns rollbackErr.
+type fakeDB struct {
+	commitErrs  []error
+	beginErr    error
+	rollbackErr error
+	begins      int
+}
+
+func (f *fakeDB) BeginTx(ctx context.Context, txOptions pgx.TxOptions) (pgx.Tx, error) {
+	f.begins++
+	if f.beginErr != nil {
+		return nil, f.beginErr
+	}
+	tx := &fakeTx{rollbackErr: f.rollbackErr}
+	if len(f.commitErrs) > 0 {
+		tx.commitErr = f.commitErrs[0]
+		f.commitErrs = f.commitErrs[1:]
+	}
+	return tx, nil
+}
+
+func TestIsRetryable(t *testing.T) {
+	for i, test := range []struct {
+		err      error
+		expected bool
+	}{
+		{&pgconn.PgError{Code: PGCodeDeadlockDetected}, true},
+		{&pgconn.PgError{Code: PGCodeSerializationFailure}, true},
+		{fmt.Errorf("wrapped: %w", &pgconn.PgError{Code: PGCodeSerializationFailure}), true},
+		{&pgconn.PgError{Code: "40003"}, false},
+		{errors.New("other error"), false},
+		{context.Canceled, false},
+	} {
+		if IsRetryable(test.err) != test.expected {
+			t.Errorf("%d: IsRetryable(%#v)=%t; expected %t", i, test.err, !test.expected, test.expected)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	policy := &RetryPolicy{}
+	for i, expected := range []time.Duration{
+		10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond,
+	} {
+		attempt := i + 1
+		if policy.maxBackoff(attempt) != expected {
+			t.Errorf("maxBackoff(%d)=%s; expected %s", attempt, policy.maxBackoff(attempt), expected)
+		}
+	}
+	if policy.maxBackoff(1000) != defaultMaxDelay {
+		t.Errorf("maxBackoff(1000)=%s; expected %s", policy.maxBackoff(1000), defaultMaxDelay)
+	}
+
+	policy = &RetryPolicy{BaseDelay: time.Second, MaxDelay: 3 * time.Second}
+	if policy.maxBackoff(3) != 3*time.Second {
+		t.Errorf("maxBackoff(3)=%s; expected MaxDelay", policy.maxBackoff(3))
+	}
+	for i := 0; i < 100; i++ {
+		delay := policy.backoff(2)
+		if !(0 <= delay && delay <= 2*time.Second) {
+			t.Fatalf("backoff(2)=%s; expected between 0 and 2s", delay)
+		}
+	}
+
+	policy = &RetryPolicy{BaseDelay: -1}
+	if policy.backoff(5) != 0 {
+		t.Errorf("negative BaseDelay: backoff(5)=%s; expected 0", policy.backoff(5))
+	}
+}
+
+func TestCanRetry(t *testing.T) {
+	policy := &RetryPolicy{MaxElapsed: time.Minute}
+	ctx := context.Background()
+	now := time.Now()
+	if !policy.canRetry(ctx, now, time.Second) {
+		t.Error("retry within MaxElapsed must be permitted")
+	}
+	if policy.canRetry(ctx, now.Add(-59*time.Second), 2*time.Second) {
+		t.Error("retry after MaxElapsed must not be permitted")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	policy = &RetryPolicy{}
+	if !policy.canRetry(ctx, now, time.Millisecond) {
+		t.Error("retry before deadline must be permitted")
+	}
+	if policy.canRetry(ctx, now, 2*time.Second) {
+		t.Error("retry after deadline must not be permitted")
+	}
+}
+
+func TestRunWithOptionsRetryPolicy(t *testing.T) {
+	ctx := context.Background()
+	serializationErr := &pgconn.PgError{Code: PGCodeSerializationFailure}
+	statementUnknownErr := &pgconn.PgError{Code: "40003"}
+	noDelay := RetryPolicy{BaseDelay: -1}
+
+	// retryable errors from commit are retried
+	db := &fakeDB{commitErrs: []error{serializationErr}}
+	body := func(ctx context.Context, tx pgx.Tx) error { return nil }
+	err := RunWithOptions(ctx, db, body, Options{RetryPolicy: noDelay})
+	if err != nil || db.begins != 2 {
+		t.Errorf("err=%v begins=%d; expected nil and 2 begins", err, db.begins)
+	}
+
+	// gives up after MaxAttempts
+	db = &fakeDB{}
+	attempts := 0
+	body = func(ctx context.Context, tx pgx.Tx) error {
+		attempts++
+		return serializationErr
+	}
+	policy := noDelay
+	policy.MaxAttempts = 5
+	err = RunWithOptions(ctx, db, body, Options{RetryPolicy: policy})
+	if err != serializationErr || attempts != 5 {
+		t.Errorf("err=%v attempts=%d; expected serialization failure after 5 attempts", err, attempts)
+	}
+
+	// the classifier can add errors
+	db = &fakeDB{commitErrs: []error{statementUnknownErr, statementUnknownErr}}
+	body = func(ctx context.Context, tx pgx.Tx) error { return nil }
+	policy = noDelay
+	policy.Retryable = func(err error) bool {
+		var pgErr *pgconn.PgError
+		return IsRetryable(err) || (errors.As(err, &pgErr) && pgErr.Code == "40003")
+	}
+	err = RunWithOptions(ctx, db, body, Options{RetryPolicy: policy})
+	if err != nil || db.begins != 3 {
+		t.Errorf("err=%v begins=%d; expected nil and 3 begins", err, db.begins)
+	}
+
+	// errors that are not retryable are returned immediately
+	db = &fakeDB{commitErrs: []error{statementUnknownErr}}
+	err = RunWithOptions(ctx, db, body, Options{RetryPolicy: noDelay})
+	if err != statementUnknownErr || db.begins != 1 {
+		t.Errorf("err=%v begins=%d; expected 40003 error and 1 begin", err, db.begins)
+	}
+
+	// cancelling ctx while waiting returns both errors
+	db = &fakeDB{commitErrs: []error{serializationErr}}
+	cancelCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	body = func(ctx context.Context, tx pgx.Tx) error {
+		cancel()
+		return nil
+	}
+	policy = RetryPolicy{BaseDelay: time.Hour, MaxDelay: time.Hour}
+	start := time.Now()
+	err = RunWithOptions(cancelCtx, db, body, Options{RetryPolicy: policy})
+	if !errors.Is(err, context.Canceled) || !errors.Is(err, serializationErr) {
+		t.Errorf("expected error to wrap context.Canceled and the serialization failure: %v", err)
+	}
+	if time.Since(start) > time.Minute {
+		t.Errorf("must not wait for the backoff after ctx is cancelled")
+	}
+}
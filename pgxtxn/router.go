@@ -0,0 +1,269 @@
+package pgxtxn
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"golang.org/x/exp/slog"
+)
+
+// default for Router.RecheckInterval
+const defaultRecheckInterval = 5 * time.Second
+
+// Postgres error codes that mean the server is shutting down or starting. Class 08 errors are
+// also connection errors. See: https://www.postgresql.org/docs/current/errcodes-appendix.html
+var pgCodesConnectionErrors = []string{
+	"57P01", // admin_shutdown
+	"57P02", // crash_shutdown
+	"57P03", // cannot_connect_now
+}
+
+// IsConnectionError returns true if err means the connection to Postgres failed or was lost,
+// for example because the server restarted. It returns false for errors caused by a done ctx.
+func IsConnectionError(err error) bool {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		for _, code := range pgCodesConnectionErrors {
+			if pgErr.Code == code {
+				return true
+			}
+		}
+		return strings.HasPrefix(pgErr.Code, "08")
+	}
+
+	var connectErr *pgconn.ConnectError
+	var netErr net.Error
+	return pgconn.SafeToRetry(err) || errors.As(err, &connectErr) || errors.As(err, &netErr) ||
+		errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.EPIPE)
+}
+
+// Router is a TransactionalDB that sends read-only transactions to replicas. Transactions with
+// AccessMode pgx.ReadOnly go to a healthy replica, chosen round-robin. All other transactions go
+// to the primary. A replica that fails with a connection error is unhealthy, and is not used until
+// RecheckInterval passes. If no replica is healthy, read-only transactions go to the primary.
+//
+// Pass a Router to Run to use its retries. By default, Run retries read-only transactions that
+// fail with connection errors, so the next attempt uses another replica.
+type Router struct {
+	// How long an unhealthy replica is not used. If 0, the default is 5 seconds. Must not be
+	// changed after the first transaction.
+	RecheckInterval time.Duration
+
+	primary  TransactionalDB
+	replicas []*replica
+	next     atomic.Uint64
+}
+
+// replica is a TransactionalDB with its health.
+type replica struct {
+	index int
+	db    TransactionalDB
+
+	mu             sync.Mutex
+	unhealthyUntil time.Time
+}
+
+func (r *replica) healthy(now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return !now.Before(r.unhealthyUntil)
+}
+
+func (r *replica) markUnhealthy(until time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.unhealthyUntil = until
+}
+
+// NewRouter returns a Router that sends transactions to primary, and read-only transactions to
+// replicas.
+func NewRouter(primary TransactionalDB, replicas ...TransactionalDB) *Router {
+	r := &Router{primary: primary}
+	for i, db := range replicas {
+		r.replicas = append(r.replicas, &replica{index: i, db: db})
+	}
+	return r
+}
+
+// BeginTx starts a transaction on the primary, or on a healthy replica if txOptions.AccessMode is
+// pgx.ReadOnly. If a replica fails to begin with a connection error, it tries the other healthy
+// replicas, then the primary.
+func (r *Router) BeginTx(ctx context.Context, txOptions pgx.TxOptions) (pgx.Tx, error) {
+	if txOptions.AccessMode != pgx.ReadOnly || len(r.replicas) == 0 {
+		return r.primary.BeginTx(ctx, txOptions)
+	}
+
+	now := time.Now()
+	start := int(r.next.Add(1) % uint64(len(r.replicas)))
+	for i := range r.replicas {
+		replica := r.replicas[(start+i)%len(r.replicas)]
+		if !replica.healthy(now) {
+			continue
+		}
+		tx, err := replica.db.BeginTx(ctx, txOptions)
+		if err == nil {
+			return &replicaTx{tx, r, replica}, nil
+		}
+		if !IsConnectionError(err) {
+			return nil, err
+		}
+		r.markUnhealthy(ctx, replica, err)
+	}
+	return r.primary.BeginTx(ctx, txOptions)
+}
+
+// HealthyReplicas returns the number of replicas that are currently used.
+func (r *Router) HealthyReplicas() int {
+	now := time.Now()
+	count := 0
+	for _, replica := range r.replicas {
+		if replica.healthy(now) {
+			count++
+		}
+	}
+	return count
+}
+
+func (r *Router) recheckInterval() time.Duration {
+	if r.RecheckInterval == 0 {
+		return defaultRecheckInterval
+	}
+	return r.RecheckInterval
+}
+
+func (r *Router) markUnhealthy(ctx context.Context, replica *replica, err error) {
+	slog.LogAttrs(ctx, slog.LevelWarn, "pgxtxn.Router: replica connection error; marking unhealthy",
+		slog.Int("replica", replica.index), slog.String("error", err.Error()))
+	replica.markUnhealthy(time.Now().Add(r.recheckInterval()))
+}
+
+// replicaTx is a transaction on a replica. It marks the replica unhealthy if the connection fails
+// after the transaction started.
+type replicaTx struct {
+	pgx.Tx
+	router  *Router
+	replica *replica
+}
+
+// check marks the replica unhealthy if err is a connection error, and returns err.
+func (t *replicaTx) check(ctx context.Context, err error) error {
+	if err != nil && IsConnectionError(err) {
+		t.router.markUnhealthy(ctx, t.replica, err)
+	}
+	return err
+}
+
+func (t *replicaTx) Exec(
+	ctx context.Context, sql string, arguments ...any,
+) (pgconn.CommandTag, error) {
+	tag, err := t.Tx.Exec(ctx, sql, arguments...)
+	return tag, t.check(ctx, err)
+}
+
+func (t *replicaTx) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	rows, err := t.Tx.Query(ctx, sql, args...)
+	if rows != nil {
+		rows = &replicaRows{rows, t, ctx}
+	}
+	return rows, t.check(ctx, err)
+}
+
+func (t *replicaTx) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	return &replicaRow{t.Tx.QueryRow(ctx, sql, args...), t, ctx}
+}
+
+func (t *replicaTx) CopyFrom(
+	ctx context.Context, tableName pgx.Identifier, columnNames []string, rowSrc pgx.CopyFromSource,
+) (int64, error) {
+	count, err := t.Tx.CopyFrom(ctx, tableName, columnNames, rowSrc)
+	return count, t.check(ctx, err)
+}
+
+func (t *replicaTx) SendBatch(ctx context.Context, b *pgx.Batch) pgx.BatchResults {
+	return &replicaBatchResults{t.Tx.SendBatch(ctx, b), t, ctx}
+}
+
+// Begin starts a savepoint that also checks errors.
+func (t *replicaTx) Begin(ctx context.Context) (pgx.Tx, error) {
+	savepoint, err := t.Tx.Begin(ctx)
+	if err != nil {
+		return nil, t.check(ctx, err)
+	}
+	return &replicaTx{savepoint, t.router, t.replica}, nil
+}
+
+func (t *replicaTx) Commit(ctx context.Context) error {
+	return t.check(ctx, t.Tx.Commit(ctx))
+}
+
+func (t *replicaTx) Rollback(ctx context.Context) error {
+	return t.check(ctx, t.Tx.Rollback(ctx))
+}
+
+// replicaRow checks the error returned by Scan.
+type replicaRow struct {
+	row pgx.Row
+	tx  *replicaTx
+	ctx context.Context
+}
+
+func (r *replicaRow) Scan(dest ...any) error {
+	return r.tx.check(r.ctx, r.row.Scan(dest...))
+}
+
+// replicaRows checks the errors returned by Err and Scan.
+type replicaRows struct {
+	pgx.Rows
+	tx  *replicaTx
+	ctx context.Context
+}
+
+func (r *replicaRows) Err() error {
+	return r.tx.check(r.ctx, r.Rows.Err())
+}
+
+func (r *replicaRows) Scan(dest ...any) error {
+	return r.tx.check(r.ctx, r.Rows.Scan(dest...))
+}
+
+// replicaBatchResults checks the errors returned by each result.
+type replicaBatchResults struct {
+	results pgx.BatchResults
+	tx      *replicaTx
+	ctx     context.Context
+}
+
+func (b *replicaBatchResults) Exec() (pgconn.CommandTag, error) {
+	tag, err := b.results.Exec()
+	return tag, b.tx.check(b.ctx, err)
+}
+
+func (b *replicaBatchResults) Query() (pgx.Rows, error) {
+	rows, err := b.results.Query()
+	if rows != nil {
+		rows = &replicaRows{rows, b.tx, b.ctx}
+	}
+	return rows, b.tx.check(b.ctx, err)
+}
+
+func (b *replicaBatchResults) QueryRow() pgx.Row {
+	return &replicaRow{b.results.QueryRow(), b.tx, b.ctx}
+}
+
+func (b *replicaBatchResults) Close() error {
+	return b.tx.check(b.ctx, b.results.Close())
+}
@@ -0,0 +1,227 @@
+package pgxtxn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestIsConnectionError(t *testing.T) {
+	for i, test := range []struct {
+		err      error
+		expected bool
+	}{
+		{io.EOF, true},
+		{fmt.Errorf("wrapped: %w", io.ErrUnexpectedEOF), true},
+		{syscall.ECONNRESET, true},
+		{&pgconn.PgError{Code: "57P01"}, true},
+		{&pgconn.PgError{Code: "08006"}, true},
+		{&pgconn.PgError{Code: PGCodeSerializationFailure}, false},
+		{context.Canceled, false},
+		{fmt.Errorf("timeout: %w", context.DeadlineExceeded), false},
+		{errors.New("other error"), false},
+	} {
+		if IsConnectionError(test.err) != test.expected {
+			t.Errorf("%d: IsConnectionError(%#v)=%t; expected %t",
+				i, test.err, !test.expected, test.expected)
+		}
+	}
+}
+
+func TestRouter(t *testing.T) {
+	ctx := context.Background()
+	readOnly := pgx.TxOptions{AccessMode: pgx.ReadOnly}
+	primary := &fakeDB{}
+	replica1 := &fakeDB{}
+	replica2 := &fakeDB{}
+	router := NewRouter(primary, replica1, replica2)
+	router.RecheckInterval = 50 * time.Millisecond
+
+	// read-write transactions use the primary; read-only transactions use the replicas
+	for i := 0; i < 4; i++ {
+		_, err := router.BeginTx(ctx, pgx.TxOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = router.BeginTx(ctx, readOnly)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if primary.begins != 4 || replica1.begins != 2 || replica2.begins != 2 {
+		t.Errorf("expected 4 primary and 2 begins per replica; begins=%d %d %d",
+			primary.begins, replica1.begins, replica2.begins)
+	}
+
+	// a replica with a connection error is not used until RecheckInterval passes
+	replica1.beginErr = syscall.ECONNREFUSED
+	for i := 0; i < 4; i++ {
+		_, err := router.BeginTx(ctx, readOnly)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if replica1.begins != 3 || replica2.begins != 6 {
+		t.Errorf("expected unhealthy replica to be tried once; begins=%d %d",
+			replica1.begins, replica2.begins)
+	}
+	if router.HealthyReplicas() != 1 {
+		t.Errorf("HealthyReplicas()=%d; expected 1", router.HealthyReplicas())
+	}
+
+	// falls back to the primary if no replica is healthy
+	replica2.beginErr = io.EOF
+	primary.begins = 0
+	_, err := router.BeginTx(ctx, readOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = router.BeginTx(ctx, readOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if primary.begins != 2 || router.HealthyReplicas() != 0 {
+		t.Errorf("expected fallback to primary; begins=%d healthy=%d",
+			primary.begins, router.HealthyReplicas())
+	}
+
+	// other errors are returned
+	time.Sleep(router.RecheckInterval)
+	if router.HealthyReplicas() != 2 {
+		t.Errorf("HealthyReplicas()=%d after RecheckInterval; expected 2", router.HealthyReplicas())
+	}
+	exampleErr := errors.New("example error")
+	replica1.beginErr = exampleErr
+	replica2.beginErr = exampleErr
+	_, err = router.BeginTx(ctx, readOnly)
+	if err != exampleErr {
+		t.Errorf("expected exampleErr; got %v", err)
+	}
+}
+
+func TestRouterRetriesReadOnly(t *testing.T) {
+	ctx := context.Background()
+	primary := &fakeDB{}
+	replica1 := &fakeDB{commitErrs: []error{io.ErrUnexpectedEOF}}
+	replica2 := &fakeDB{commitErrs: []error{io.ErrUnexpectedEOF}}
+	router := NewRouter(primary, replica1, replica2)
+
+	// the lost connections are retried on the other replica, then the primary
+	err := RunTx(ctx, router, func(ctx context.Context, tx Tx) error { return nil }, Options{
+		TxOptions:   pgx.TxOptions{AccessMode: pgx.ReadOnly},
+		RetryPolicy: RetryPolicy{BaseDelay: -1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replica1.begins != 1 || replica2.begins != 1 || primary.begins != 1 {
+		t.Errorf("expected one begin on each db; begins=%d %d %d",
+			primary.begins, replica1.begins, replica2.begins)
+	}
+
+	// read-write transactions are not retried after connection errors
+	primary.commitErrs = []error{io.ErrUnexpectedEOF}
+	err = RunTx(ctx, router, func(ctx context.Context, tx Tx) error { return nil },
+		Options{RetryPolicy: RetryPolicy{BaseDelay: -1}})
+	if err != io.ErrUnexpectedEOF || primary.begins != 2 {
+		t.Errorf("expected connection error without retry; err=%v begins=%d", err, primary.begins)
+	}
+}
+
+// lostConnTx is a pgx.Tx where every operation fails with a connection error.
+type lostConnTx struct {
+	pgx.Tx
+}
+
+func (l *lostConnTx) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	return &lostConnRows{}, nil
+}
+
+func (l *lostConnTx) CopyFrom(
+	ctx context.Context, tableName pgx.Identifier, columnNames []string, rowSrc pgx.CopyFromSource,
+) (int64, error) {
+	return 0, io.ErrUnexpectedEOF
+}
+
+func (l *lostConnTx) SendBatch(ctx context.Context, b *pgx.Batch) pgx.BatchResults {
+	return &lostConnBatchResults{}
+}
+
+func (l *lostConnTx) Begin(ctx context.Context) (pgx.Tx, error) {
+	return nil, io.ErrUnexpectedEOF
+}
+
+func (l *lostConnTx) Rollback(ctx context.Context) error {
+	return io.ErrUnexpectedEOF
+}
+
+// lostConnRows returns a connection error from Err.
+type lostConnRows struct {
+	pgx.Rows
+}
+
+func (l *lostConnRows) Next() bool { return false }
+func (l *lostConnRows) Err() error { return io.ErrUnexpectedEOF }
+
+// lostConnBatchResults returns a connection error from Close.
+type lostConnBatchResults struct {
+	pgx.BatchResults
+}
+
+func (l *lostConnBatchResults) Close() error { return io.ErrUnexpectedEOF }
+
+// lostConnDB begins lostConnTxs.
+type lostConnDB struct{}
+
+func (lostConnDB) BeginTx(ctx context.Context, txOptions pgx.TxOptions) (pgx.Tx, error) {
+	return &lostConnTx{}, nil
+}
+
+func TestRouterMarksUnhealthyAfterBegin(t *testing.T) {
+	ctx := context.Background()
+	for name, op := range map[string]func(tx pgx.Tx) error{
+		"Rows.Err": func(tx pgx.Tx) error {
+			rows, err := tx.Query(ctx, "SELECT 1")
+			if err != nil {
+				return err
+			}
+			for rows.Next() {
+			}
+			return rows.Err()
+		},
+		"CopyFrom": func(tx pgx.Tx) error {
+			_, err := tx.CopyFrom(ctx, pgx.Identifier{"example"}, nil, pgx.CopyFromRows(nil))
+			return err
+		},
+		"SendBatch": func(tx pgx.Tx) error {
+			return tx.SendBatch(ctx, &pgx.Batch{}).Close()
+		},
+		"Begin": func(tx pgx.Tx) error {
+			_, err := tx.Begin(ctx)
+			return err
+		},
+		"Rollback": func(tx pgx.Tx) error {
+			return tx.Rollback(ctx)
+		},
+	} {
+		router := NewRouter(&fakeDB{}, lostConnDB{})
+		tx, err := router.BeginTx(ctx, pgx.TxOptions{AccessMode: pgx.ReadOnly})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = op(tx)
+		if err != io.ErrUnexpectedEOF {
+			t.Errorf("%s: expected connection error; got %v", name, err)
+		}
+		if router.HealthyReplicas() != 0 {
+			t.Errorf("%s: connection error must mark the replica unhealthy", name)
+		}
+	}
+}
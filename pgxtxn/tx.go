@@ -0,0 +1,99 @@
+package pgxtxn
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Tx is the part of pgx.Tx that transaction bodies passed to RunTx and RunValue can use. It does
+// not have Commit or Rollback, since committing in the body defeats the retries.
+type Tx interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	CopyFrom(
+		ctx context.Context, tableName pgx.Identifier, columnNames []string, rowSrc pgx.CopyFromSource,
+	) (int64, error)
+	SendBatch(ctx context.Context, b *pgx.Batch) pgx.BatchResults
+
+	// Savepoint executes body in a nested transaction using a SAVEPOINT. If body returns an error,
+	// the changes made by body are rolled back and Savepoint returns the error, but the enclosing
+	// transaction can continue. Otherwise, the savepoint is released. Callbacks registered with
+	// OnCommit by body are discarded if the savepoint is rolled back.
+	Savepoint(ctx context.Context, body func(ctx context.Context, tx Tx) error) error
+}
+
+// restrictedTx implements Tx with a pgx.Tx. It does not embed pgx.Tx, so the body cannot use a
+// type assertion to call Commit.
+type restrictedTx struct {
+	tx pgx.Tx
+}
+
+func (r *restrictedTx) Exec(
+	ctx context.Context, sql string, arguments ...any,
+) (pgconn.CommandTag, error) {
+	return r.tx.Exec(ctx, sql, arguments...)
+}
+
+func (r *restrictedTx) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	return r.tx.Query(ctx, sql, args...)
+}
+
+func (r *restrictedTx) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	return r.tx.QueryRow(ctx, sql, args...)
+}
+
+func (r *restrictedTx) CopyFrom(
+	ctx context.Context, tableName pgx.Identifier, columnNames []string, rowSrc pgx.CopyFromSource,
+) (int64, error) {
+	return r.tx.CopyFrom(ctx, tableName, columnNames, rowSrc)
+}
+
+func (r *restrictedTx) SendBatch(ctx context.Context, b *pgx.Batch) pgx.BatchResults {
+	return r.tx.SendBatch(ctx, b)
+}
+
+func (r *restrictedTx) Savepoint(
+	ctx context.Context, body func(ctx context.Context, tx Tx) error,
+) error {
+	enclosing, _ := ctx.Value(enclosingTxKey{}).(*enclosingTx)
+	var db TransactionalDB
+	if enclosing != nil {
+		db = enclosing.db
+	}
+	return runNested(ctx, db, r.tx, func(ctx context.Context, tx pgx.Tx) error {
+		return body(ctx, &restrictedTx{tx})
+	})
+}
+
+// RunTx is RunWithOptions, but body cannot commit or roll back the transaction.
+func RunTx(
+	ctx context.Context, db TransactionalDB, body func(ctx context.Context, tx Tx) error,
+	options Options,
+) error {
+	_, err := RunValue(ctx, db, func(ctx context.Context, tx Tx) (struct{}, error) {
+		return struct{}{}, body(ctx, tx)
+	}, options)
+	return err
+}
+
+// RunValue is RunTx for a body that returns a result. It returns the result from the attempt that
+// committed, or the zero value of T with an error.
+func RunValue[T any](
+	ctx context.Context, db TransactionalDB, body func(ctx context.Context, tx Tx) (T, error),
+	options Options,
+) (T, error) {
+	var result T
+	err := RunWithOptions(ctx, db, func(ctx context.Context, tx pgx.Tx) error {
+		var err error
+		result, err = body(ctx, &restrictedTx{tx})
+		return err
+	}, options)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return result, nil
+}
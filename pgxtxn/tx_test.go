@@ -0,0 +1,106 @@
+package pgxtxn
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/evanj/hacks/postgrestest"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func TestRunValueRetries(t *testing.T) {
+	ctx := context.Background()
+	db := &fakeDB{commitErrs: []error{&pgconn.PgError{Code: PGCodeDeadlockDetected}}}
+	attempts := 0
+	value, err := RunValue(ctx, db, func(ctx context.Context, tx Tx) (int, error) {
+		attempts++
+		if _, ok := tx.(interface{ Commit(context.Context) error }); ok {
+			t.Error("Tx must not have Commit")
+		}
+		return attempts * 10, nil
+	}, Options{RetryPolicy: RetryPolicy{BaseDelay: -1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != 20 {
+		t.Errorf("expected the value from the second attempt=20; got %d", value)
+	}
+
+	exampleErr := errors.New("example error")
+	value, err = RunValue(ctx, &fakeDB{}, func(ctx context.Context, tx Tx) (int, error) {
+		return 42, exampleErr
+	}, Options{})
+	if err != exampleErr || value != 0 {
+		t.Errorf("expected zero value with error; got value=%d err=%v", value, err)
+	}
+}
+
+func TestRunTxSavepoint(t *testing.T) {
+	pgURL := postgrestest.New(t)
+	ctx := context.Background()
+	pgPool, err := pgxpool.New(ctx, pgURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pgPool.Close()
+	_, err = pgPool.Exec(ctx, `CREATE TABLE example (value INTEGER NOT NULL PRIMARY KEY)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exampleErr := errors.New("example error")
+	err = RunTx(ctx, pgPool, func(ctx context.Context, tx Tx) error {
+		_, err := tx.Exec(ctx, `INSERT INTO example VALUES (1)`)
+		if err != nil {
+			return err
+		}
+
+		// a failed statement in a savepoint does not abort the enclosing transaction
+		err = tx.Savepoint(ctx, func(ctx context.Context, tx Tx) error {
+			_, err := tx.Exec(ctx, `INSERT INTO example VALUES (1)`)
+			return err
+		})
+		var pgErr *pgconn.PgError
+		if !errors.As(err, &pgErr) || pgErr.Code != "23505" {
+			t.Errorf("expected unique violation from savepoint; got %v", err)
+		}
+
+		// changes in a savepoint are rolled back if body returns an error
+		err = tx.Savepoint(ctx, func(ctx context.Context, tx Tx) error {
+			_, err := tx.Exec(ctx, `INSERT INTO example VALUES (2)`)
+			if err != nil {
+				return err
+			}
+			return exampleErr
+		})
+		if err != exampleErr {
+			t.Errorf("expected exampleErr from savepoint; got %v", err)
+		}
+
+		// changes in a savepoint are kept if it succeeds
+		return tx.Savepoint(ctx, func(ctx context.Context, tx Tx) error {
+			_, err := tx.Exec(ctx, `INSERT INTO example VALUES (3)`)
+			return err
+		})
+	}, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values, err := RunValue(ctx, pgPool, func(ctx context.Context, tx Tx) ([]int32, error) {
+		rows, err := tx.Query(ctx, `SELECT value FROM example ORDER BY value`)
+		if err != nil {
+			return nil, err
+		}
+		return pgx.CollectRows(rows, pgx.RowTo[int32])
+	}, Options{TxOptions: pgx.TxOptions{AccessMode: pgx.ReadOnly}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(values) != 2 || values[0] != 1 || values[1] != 3 {
+		t.Errorf("expected values [1 3]; got %v", values)
+	}
+}
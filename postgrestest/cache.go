@@ -0,0 +1,141 @@
+package postgrestest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/exp/slog"
+)
+
+// present in every initialized Postgres data directory
+const pgVersionFileName = "PG_VERSION"
+
+// initDBCacheKey returns the name of the cache entry for the initdb output. initdb uses the current
+// user as the superuser name, so this is also part of the key.
+func initDBCacheKey(cfg *pgConfig, username string) string {
+	parts := append([]string{cfg.version, username}, initDBArgs()...)
+	hash := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return "initdb_" + hex.EncodeToString(hash[:16])
+}
+
+// initializeFromCache copies an initialized data directory from cacheDir to dbDir. If the cache
+// does not contain an entry, it runs initdb in dbDir and adds a copy to the cache.
+func initializeFromCache(
+	dbDir string, cacheDir string, logger *slog.Logger, cfg *pgConfig, output io.Writer,
+) error {
+	superuser, err := cfg.runAs.superuserName()
+	if err != nil {
+		return err
+	}
+	entryDir := filepath.Join(cacheDir, initDBCacheKey(cfg, superuser))
+	_, err = os.Stat(filepath.Join(entryDir, pgVersionFileName))
+	if os.IsNotExist(err) {
+		// initdb writes to dbDir and not the cache, so it works when running as root (see
+		// Options.UnprivilegedUser) without the unprivileged user needing access to the cache
+		logger.Info("initdb cache miss: populating cache", "cache_dir", entryDir)
+		err = initializePostgresDir(dbDir, logger, cfg, output)
+		if err != nil {
+			return err
+		}
+		return populateInitDBCache(entryDir, dbDir)
+	}
+	if err != nil {
+		return err
+	}
+
+	logger.Info("copying cached initdb output", "cache_dir", entryDir, "dir", dbDir)
+	return copyDir(dbDir, entryDir)
+}
+
+// populateInitDBCache copies the initialized srcDir to a temporary directory then renames it to
+// entryDir, so concurrent processes never see a partially initialized entry.
+func populateInitDBCache(entryDir string, srcDir string) error {
+	cacheDir := filepath.Dir(entryDir)
+	err := os.MkdirAll(cacheDir, 0700)
+	if err != nil {
+		return err
+	}
+	tempDir, err := os.MkdirTemp(cacheDir, "tmp_")
+	if err != nil {
+		return err
+	}
+	err = copyDir(tempDir, srcDir)
+	if err == nil {
+		err = os.Rename(tempDir, entryDir)
+		if err != nil {
+			// another process may have populated the entry first: use it
+			_, statErr := os.Stat(filepath.Join(entryDir, pgVersionFileName))
+			if statErr == nil {
+				err = nil
+			}
+		}
+	}
+	os.RemoveAll(tempDir)
+	return err
+}
+
+// copyDir copies the files in srcDir to dstDir, which must exist, preserving permissions.
+func copyDir(dstDir string, srcDir string) error {
+	return filepath.WalkDir(srcDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(srcDir, path)
+		if err != nil {
+			return err
+		}
+		dstPath := filepath.Join(dstDir, relPath)
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case entry.IsDir():
+			if relPath == "." {
+				return os.Chmod(dstDir, info.Mode().Perm())
+			}
+			return os.Mkdir(dstPath, info.Mode().Perm())
+		case entry.Type()&fs.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(target, dstPath)
+		case entry.Type().IsRegular():
+			return copyFile(dstPath, path, info.Mode().Perm())
+		default:
+			return fmt.Errorf("postgrestest: cannot copy unsupported file type: %s", path)
+		}
+	})
+}
+
+// copyFile copies srcPath to a new file at dstPath. It uses a copy-on-write clone if the file
+// system supports it.
+func copyFile(dstPath string, srcPath string, perm fs.FileMode) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	err = cloneFile(dst, src)
+	if err != nil {
+		_, err = io.Copy(dst, src)
+		if err != nil {
+			return err
+		}
+	}
+	return dst.Close()
+}
@@ -0,0 +1,98 @@
+package postgrestest
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func TestCopyDir(t *testing.T) {
+	srcDir := t.TempDir()
+	err := os.Mkdir(filepath.Join(srcDir, "subdir"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(srcDir, "subdir", "file"), []byte("hello"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Symlink("subdir/file", filepath.Join(srcDir, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chmod(srcDir, 0750)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dstDir := t.TempDir()
+	err = copyDir(dstDir, srcDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dstDir, "link"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "hello" {
+		t.Errorf("unexpected file contents: %#v", string(data))
+	}
+	info, err := os.Stat(filepath.Join(dstDir, "subdir", "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected file mode 0600; was %s", info.Mode())
+	}
+	info, err = os.Stat(dstDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0750 {
+		t.Errorf("expected dir mode 0750; was %s", info.Mode())
+	}
+}
+
+func TestInitDBCache(t *testing.T) {
+	cacheDir := t.TempDir()
+
+	// the first instance populates the cache; the second copies it
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		instance, err := NewInstanceWithOptions(ctx, Options{InitDBCacheDir: cacheDir})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer instance.Close()
+
+		conn, err := pgx.Connect(ctx, instance.URL())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close(ctx)
+		_, err = conn.Exec(ctx, `CREATE TABLE example (id INTEGER)`)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = conn.Close(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = instance.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := os.ReadDir(cacheDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected exactly one cache entry; found %d", len(entries))
+	}
+}
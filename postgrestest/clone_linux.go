@@ -0,0 +1,13 @@
+package postgrestest
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// cloneFile makes dst a copy-on-write clone of src (a reflink). It fails if the file system does
+// not support it (e.g. ext4).
+func cloneFile(dst *os.File, src *os.File) error {
+	return unix.IoctlFileClone(int(dst.Fd()), int(src.Fd()))
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package postgrestest
+
+import (
+	"errors"
+	"os"
+)
+
+// cloneFile is only implemented on Linux: the caller falls back to copying.
+func cloneFile(dst *os.File, src *os.File) error {
+	return errors.ErrUnsupported
+}
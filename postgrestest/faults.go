@@ -0,0 +1,103 @@
+package postgrestest
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// errFaultsNotSupported is returned by the fault injection methods if this process does not
+// control the Postgres process.
+var errFaultsNotSupported = errors.New(
+	"postgrestest: fault injection requires a running instance that is not shared")
+
+// checkCanInjectFaults returns an error if this process did not start Postgres.
+func (i *Instance) checkCanInjectFaults() error {
+	if i.proc == nil || i.shared != nil {
+		return errFaultsNotSupported
+	}
+	return nil
+}
+
+// Restart shuts down Postgres cleanly then starts it again. Existing connections are closed. The
+// instance keeps the same URL and data. If starting fails, Restart can be called again.
+func (i *Instance) Restart(ctx context.Context) error {
+	err := i.checkCanInjectFaults()
+	if err != nil {
+		return err
+	}
+	// the process exited if a previous Restart or Crash failed to start it
+	if !i.proc.exited() {
+		// SIGINT = fast shutdown: disconnects clients and writes a checkpoint. See:
+		// https://www.postgresql.org/docs/current/server-shutdown.html
+		err = i.proc.cmd.Process.Signal(syscall.SIGINT)
+		if err != nil {
+			return err
+		}
+		err = i.proc.wait()
+		if err != nil {
+			return err
+		}
+	}
+	return i.startServer(ctx, nil)
+}
+
+// Crash kills all Postgres processes with SIGKILL, simulating a crash, then starts it again. On
+// startup, Postgres recovers committed transactions from the write-ahead log. The instance keeps
+// the same URL and data. If starting fails, Restart can be called to try again.
+func (i *Instance) Crash(ctx context.Context) error {
+	err := i.checkCanInjectFaults()
+	if err != nil {
+		return err
+	}
+	if !i.proc.exited() {
+		// postgres is the leader of its process group: this kills the postmaster and all backends
+		err = syscall.Kill(-i.proc.cmd.Process.Pid, syscall.SIGKILL)
+		if err != nil {
+			return err
+		}
+		// ignore the exit status: it was killed
+		i.proc.wait()
+	}
+	return i.startServer(ctx, nil)
+}
+
+// Pause stops all Postgres processes with SIGSTOP, waits for duration, then resumes them with
+// SIGCONT. This simulates a server that is unresponsive, e.g. due to a network partition or a slow
+// disk. It blocks until the processes are resumed, so tests should call it from a goroutine.
+func (i *Instance) Pause(duration time.Duration) error {
+	err := i.checkCanInjectFaults()
+	if err != nil {
+		return err
+	}
+	pgid := -i.proc.cmd.Process.Pid
+	err = syscall.Kill(pgid, syscall.SIGSTOP)
+	if err != nil {
+		return err
+	}
+	time.Sleep(duration)
+	return syscall.Kill(pgid, syscall.SIGCONT)
+}
+
+// TerminateBackends terminates all client connections except the one it uses, and returns the
+// number it terminated. Clients will get an error on their next query, as if the connection was
+// closed by the server.
+func (i *Instance) TerminateBackends(ctx context.Context) (int, error) {
+	conn, err := pgx.Connect(ctx, i.URL())
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close(ctx)
+	var count int
+	err = conn.QueryRow(ctx, `SELECT COUNT(*) FROM (
+		SELECT pg_terminate_backend(pid) FROM pg_stat_activity
+		WHERE backend_type = 'client backend' AND pid <> pg_backend_pid()
+	) AS terminated`).Scan(&count)
+	if err != nil {
+		return 0, err
+	}
+	return count, conn.Close(ctx)
+}
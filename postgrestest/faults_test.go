@@ -0,0 +1,119 @@
+package postgrestest
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func TestFaults(t *testing.T) {
+	instance, err := NewInstance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instance.Close()
+
+	ctx := context.Background()
+	err = instance.execSQL(ctx, defaultDatabase,
+		`CREATE TABLE example (id INTEGER PRIMARY KEY)`,
+		`INSERT INTO example VALUES (1)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := instance.URL()
+
+	conn, err := pgx.Connect(ctx, url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(ctx)
+	terminated, err := instance.TerminateBackends(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if terminated != 1 {
+		t.Errorf("expected TerminateBackends to terminate 1 connection; terminated=%d", terminated)
+	}
+	err = conn.Ping(ctx)
+	if err == nil {
+		t.Error("expected query on terminated connection to fail")
+	}
+
+	// the query must block until the server resumes
+	const pauseDuration = 200 * time.Millisecond
+	pauseErr := make(chan error, 1)
+	start := time.Now()
+	go func() {
+		pauseErr <- instance.Pause(pauseDuration)
+	}()
+	time.Sleep(pauseDuration / 4)
+	err = instance.execSQL(ctx, defaultDatabase, `SELECT 1`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < pauseDuration {
+		t.Errorf("query must wait for Pause to complete; elapsed=%s", elapsed)
+	}
+	err = <-pauseErr
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, fault := range []func(context.Context) error{instance.Restart, instance.Crash} {
+		err = fault(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if instance.URL() != url {
+			t.Errorf("fault %d changed URL: %s != %s", i, instance.URL(), url)
+		}
+
+		conn, err := pgx.Connect(ctx, url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close(ctx)
+		var count int
+		err = conn.QueryRow(ctx, `SELECT COUNT(*) FROM example`).Scan(&count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 1 {
+			t.Errorf("fault %d lost data: expected count=1; was %d", i, count)
+		}
+		err = conn.Close(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCloseAfterServerExited(t *testing.T) {
+	// simulates a Restart or Crash that failed to start postgres again
+	dir, err := os.MkdirTemp("", tempDirPrefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	proc, err := startServerProcess(exec.Command("true"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proc.wait()
+	if !proc.exited() {
+		t.Fatal("exited() must return true after wait()")
+	}
+
+	instance := &Instance{dbDir: dir, proc: proc}
+	err = instance.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("Close must delete the directory: %v", err)
+	}
+}
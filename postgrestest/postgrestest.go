@@ -6,24 +6,26 @@ import (
 	"bytes"
 	"context"
 	cryptorand "crypto/rand"
-	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/url"
 	"os"
 	"os/exec"
-	"os/user"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
 	"testing"
 	"time"
 
 	"github.com/evanj/hacks/nilslog"
+	"github.com/evanj/hacks/pgwire"
 	"github.com/jackc/pgx/v5"
+	"golang.org/x/exp/maps"
 	"golang.org/x/exp/slices"
 	"golang.org/x/exp/slog"
 )
@@ -33,6 +35,9 @@ const pgSocketFileNamePrefix = ".s.PGSQL."
 
 const pgAuthConfigFileName = "pg_hba.conf"
 
+// appended to pg_hba.conf when using Options.InsecureGlobalPort
+const insecureGlobalAuthConfig = "\nhostnossl all all 0.0.0.0/0 scram-sha-256\nhostnossl all all ::0/0 scram-sha-256\n"
+
 // LANG=C sets the "default" C locale, which is really "no locale support"
 // we call initdb with arguments to use a default ICU locale with reasonable Unicode support
 const langEnvVar = "LANG"
@@ -40,12 +45,22 @@ const cLocale = "C"
 
 const defaultPort = 5432
 
+// default for Options.StartupTimeout
+const defaultStartupTimeout = 30 * time.Second
+
+// a tmpfs file system on Linux, used by Options.FastUnsafe
+const memoryTempDir = "/dev/shm"
+
+// the database created by initdb that URL() connects to
+const defaultDatabase = "postgres"
+
 // Options configures the Postgres instance.
 type Options struct {
 	// If true, Postgres will listen on localhost for network connections.
 	ListenOnLocalhost bool
 
-	// If not nil, verbose information will be logged.
+	// If not nil, verbose information will be logged, including each line of output from initdb
+	// and postgres. The output is also available from Instance.ServerLog().
 	Logger *slog.Logger
 
 	// If not 0, listen globally on InsecureGlobalPort. This is insecure because it will allow
@@ -54,13 +69,67 @@ type Options struct {
 	// option will listen on localhost addresses as well.
 	InsecureGlobalPort int
 
+	// If true, generate a temporary CA and a server certificate signed by it, and enable TLS. TLS
+	// connections require a password. Use Instance.TLSURL() to connect and verify the server's
+	// certificate. If InsecureGlobalPort is not set, Postgres will listen on localhost.
+	TLS bool
+
 	// Set Postgres's shared_buffers for the buffer pool cache in bytes. See:
 	// https://www.postgresql.org/docs/current/runtime-config-resource.html
 	SharedBuffers int
 
+	// If true, disable crash safety to make Postgres faster: turns off fsync, synchronous_commit
+	// and full_page_writes, and limits the size of the write-ahead log. If DirPath is empty and
+	// /dev/shm exists, the temporary directory is created there so it is stored in memory. A
+	// crash or power failure can corrupt the data, so this should only be used for tests.
+	FastUnsafe bool
+
+	// Server configuration parameters passed to postgres with -c name=value. These override
+	// settings from other options. For example: {"log_statement": "all"}. See:
+	// https://www.postgresql.org/docs/current/runtime-config.html
+	ServerConfig map[string]string
+
+	// Libraries to load when the server starts with shared_preload_libraries. Some extensions
+	// require this, such as pg_stat_statements.
+	SharedPreloadLibraries []string
+
+	// Extensions to create with CREATE EXTENSION once the server is ready. They are created in
+	// the postgres and template1 databases, so new databases will also have them.
+	Extensions []string
+
+	// If not empty, the result of initdb is cached in this directory, and new instances copy it
+	// instead of running initdb. Entries are keyed by the Postgres version and initdb arguments.
+	// Copying is faster than initdb, particularly on file systems that support copy-on-write.
+	InitDBCacheDir string
+
+	// Maximum time to wait for Postgres to accept connections after it starts. If 0, the default is
+	// 30 seconds.
+	StartupTimeout time.Duration
+
+	// If not 0, use this major version of Postgres (e.g. 15). See InstalledVersions. If both
+	// Version and BinDir are set, the version in BinDir must match.
+	Version int
+
+	// If not empty, use the Postgres binaries in this directory. Otherwise, use pg_config on PATH
+	// to find them.
+	BinDir string
+
 	// Create or use Postgres in this directory. If empty, it will create a temporary directory
-	// that will be deleted when done. If this is set, the directory will not be deleted.
+	// that will be deleted when done. If this is set, the directory will not be deleted. If the
+	// directory already contains a Postgres data directory, it must have been created by the same
+	// major version of Postgres.
 	DirPath string
+
+	// Postgres refuses to run as root. If the current process is root, initdb and postgres run as
+	// this user instead, and the directory is changed to be owned by it. The parent directories of
+	// DirPath must be accessible by this user. This user is also the Postgres superuser. If empty,
+	// the default is "postgres", which is created by the Debian and Ubuntu packages.
+	UnprivilegedUser string
+
+	// If not nil, collect statistics about executed statements with pg_stat_statements, and log
+	// slow statements. NewWithOptions reports the statistics when the test completes. Use
+	// Instance.QueryStats() to read them.
+	QueryStats *QueryStatsOptions
 }
 
 // New creates a new Postgres instance and returns a connection string URL in the
@@ -68,35 +137,71 @@ type Options struct {
 // instance will be shut down. New will call t.Fatal if an error happens initializing Postgres.
 // See NewInstanceWithOptions for more details.
 func New(t testing.TB) string {
-	instance, err := NewInstance()
+	return NewWithOptions(t, Options{})
+}
+
+// NewWithOptions is like New but calls NewInstanceWithOptions with options.
+func NewWithOptions(t testing.TB, options Options) string {
+	instance, err := NewInstanceWithOptions(context.Background(), options)
 	if err != nil {
 		t.Fatalf("failed starting postgres: %s", err.Error())
 		// Fatalf should terminate execution, but just in case, don't return "": it is a valid string!
 		return "invalid_connection_string"
 	}
 	t.Cleanup(func() {
+		if options.QueryStats != nil {
+			reportQueryStats(t, instance, options.QueryStats)
+		}
 		err := instance.Close()
 		if err != nil {
 			t.Logf("warning: error shutting down Postgres: %s", err.Error())
 		}
+		if t.Failed() {
+			t.Logf("postgres output:\n%s", instance.ServerLog())
+		}
 	})
 	return instance.URL()
 }
 
 // Instance contains the state of a new temporary Postgres instance.
 type Instance struct {
-	proc       *exec.Cmd
+	proc       *serverProcess
 	cfg        *pgConfig
 	dbDir      string
 	globalPort int
 	username   string
 	password   string
+
+	// output from initdb and postgres; nil if shared with other processes
+	log *serverLog
+
+	// if true, Close() does not delete dbDir
+	keepDir bool
+
+	// the options used to start the instance
+	options Options
+
+	// the primary if this is a replica created by StartReplica
+	primary *Instance
+
+	// the CA certificate if using Options.TLS
+	tlsCACertPEM []byte
+
+	// not nil if this instance is shared with other processes. See NewSharedInstance.
+	shared *sharedAttachment
+
+	// users created by CreateUser, mapped to their password, or "" for peer authentication
+	usersMu sync.Mutex
+	users   map[string]string
+
+	// locked while this process owns a temporary instance; nil otherwise. See Reap.
+	ownerLock *os.File
 }
 
 // NewInstance calls NewInstanceWithOptions() with the default options. The caller must call Close()
 // to ensure it is stopped and the temporary space is deleted. Tests should prefer to call New().
 func NewInstance() (*Instance, error) {
-	return NewInstanceWithOptions(Options{})
+	return NewInstanceWithOptions(context.Background(), Options{})
 }
 
 // environWithFixedLang replaces the LANG environment variable with cLocale
@@ -117,7 +222,9 @@ func environWithFixedLang() []string {
 // call New().
 //
 // Postgres will use the "C" locale to ensure that tests don't depend on the local environment.
-func NewInstanceWithOptions(options Options) (*Instance, error) {
+// If Postgres does not start before ctx is done or Options.StartupTimeout expires, or if it exits
+// while starting, it returns a *StartupError.
+func NewInstanceWithOptions(ctx context.Context, options Options) (*Instance, error) {
 	if options.ListenOnLocalhost && options.InsecureGlobalPort != 0 {
 		return nil, errors.New("cannot set both ListenOnLocalhost and GlobalPort")
 	}
@@ -127,118 +234,199 @@ func NewInstanceWithOptions(options Options) (*Instance, error) {
 
 	options.Logger = nilslog.NewIfNil(options.Logger)
 
-	shouldCleanUpDir := true
-	dir, err := os.MkdirTemp("", "postgrestest_")
+	if options.DirPath != "" {
+		err := os.MkdirAll(options.DirPath, 0700)
+		if err != nil {
+			return nil, err
+		}
+		instance, err := startInstance(ctx, options.DirPath, options, nil, false)
+		if err != nil {
+			return nil, err
+		}
+		instance.keepDir = true
+		return instance, nil
+	}
+
+	dir, err := os.MkdirTemp(tempDirParent(options), tempDirPrefix)
 	if err != nil {
 		return nil, err
 	}
-	defer func() {
-		if shouldCleanUpDir {
-			os.RemoveAll(dir)
+	instance, err := startInstance(ctx, dir, options, nil, true)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return instance, nil
+}
+
+// usesPassword returns true if the options allow connections that require a password.
+func (o Options) usesPassword() bool {
+	return o.InsecureGlobalPort != 0 || o.TLS
+}
+
+// prependAuthConfig inserts rules at the start of pg_hba.conf in dir, unless it already has them.
+// The first matching rule is used, so these take precedence over the defaults.
+func prependAuthConfig(dir string, rules string) error {
+	authConfigPath := filepath.Join(dir, pgAuthConfigFileName)
+	authConfig, err := os.ReadFile(authConfigPath)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(authConfig, []byte(rules)) {
+		return nil
+	}
+	return os.WriteFile(authConfigPath, append([]byte(rules), authConfig...), 0600)
+}
+
+// tempDirParent returns the directory for temporary instances, or "" for the default temp dir.
+func tempDirParent(options Options) string {
+	if options.FastUnsafe {
+		info, err := os.Stat(memoryTempDir)
+		if err == nil && info.IsDir() {
+			return memoryTempDir
 		}
-	}()
+	}
+	return ""
+}
 
-	cfg, err := readPGConfig(options.Logger)
+// startInstance initializes Postgres in dir and starts it. If logFile is not nil, the output of
+// initdb and postgres is written to it, and postgres is started in a new process group so it
+// can continue running after this process exits. Otherwise, the output is captured by the
+// Instance's serverLog. If temporary is true, this process locks an owner lock file in dir, so
+// Reap can delete it if this process exits without calling Close.
+func startInstance(
+	ctx context.Context, dir string, options Options, logFile *os.File, temporary bool,
+) (*Instance, error) {
+	cfg, err := findPGConfig(options)
+	if err != nil {
+		return nil, err
+	}
+	cfg.runAs, err = lookupRunAsUser(options.UnprivilegedUser)
+	if err != nil {
+		return nil, err
+	}
+	err = cfg.runAs.chown(dir)
 	if err != nil {
 		return nil, err
 	}
 
-	err = initializePostgresDir(dir, options.Logger, cfg)
+	serverLog := newServerLog(options.Logger)
+	initDBOutput := serverLog.writer("initdb")
+	if logFile != nil {
+		initDBOutput = logFile
+	}
+
+	initialized, err := isInitialized(dir, cfg)
 	if err != nil {
 		return nil, err
 	}
+	if initialized {
+		options.Logger.Info("using existing Postgres data directory", "dir", dir)
+	} else if options.InitDBCacheDir != "" {
+		err = initializeFromCache(dir, options.InitDBCacheDir, options.Logger, cfg, initDBOutput)
+	} else {
+		err = initializePostgresDir(dir, options.Logger, cfg, initDBOutput)
+	}
+	if err != nil {
+		return nil, &StartupError{"initializing data directory failed", err,
+			serverLog.lastLines(startupErrorLogLines)}
+	}
 
-	// add pg_hba.conf entries if needed
+	// add pg_hba.conf entries if needed; an existing directory may already have them
 	if options.InsecureGlobalPort != 0 {
-		f, err := os.OpenFile(filepath.Join(dir, pgAuthConfigFileName), os.O_APPEND|os.O_WRONLY, 0000)
+		authConfigPath := filepath.Join(dir, pgAuthConfigFileName)
+		authConfig, err := os.ReadFile(authConfigPath)
 		if err != nil {
 			return nil, err
 		}
-		_, err = fmt.Fprintf(f, "\nhostnossl all all 0.0.0.0/0 scram-sha-256\nhostnossl all all ::0/0 scram-sha-256\n")
-		if err != nil {
-			return nil, err
+		if !bytes.Contains(authConfig, []byte(insecureGlobalAuthConfig)) {
+			f, err := os.OpenFile(authConfigPath, os.O_APPEND|os.O_WRONLY, 0000)
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+			_, err = f.WriteString(insecureGlobalAuthConfig)
+			if err != nil {
+				return nil, err
+			}
 		}
 	}
 
-	// By default Postgres puts its Unix-domain socket in /tmp; "-k ." puts it in the data dir.
-	// however, then on Mac OS X we get "socket name too long" because the absolute path to the
-	// socket can't exceed 100 characters
-	postgresPath := cfg.binPath("postgres")
-
-	// default for Postgres with no arguments: listen on localhost
-	// -h "": do not listen for TCP
-	// -h "*": listen on all addresses
-	args := []string{"-D", dir, "-k", "."}
-	if !options.ListenOnLocalhost {
-		if options.InsecureGlobalPort == 0 {
-			args = append(args, "-h", "")
-		} else {
-			args = append(args, "-h", "*", "-p", strconv.Itoa(options.InsecureGlobalPort))
+	var tlsCACertPEM []byte
+	if options.TLS {
+		var ipAddresses []net.IP
+		if options.InsecureGlobalPort != 0 {
+			ipAddresses, err = globalUnicastAddresses()
+			if err != nil {
+				return nil, err
+			}
+		}
+		tlsCACertPEM, err = writeTLSFiles(dir, ipAddresses)
+		if err != nil {
+			return nil, err
+		}
+		err = prependAuthConfig(dir, tlsAuthConfig)
+		if err != nil {
+			return nil, err
 		}
 	}
-	if options.SharedBuffers != 0 {
-		args = append(args, "-c", fmt.Sprintf("shared_buffers=%dB", options.SharedBuffers))
-	}
-	proc := commandPassOutput(options.Logger, postgresPath, args...)
-	err = proc.Start()
+
+	// files copied from the cache or written above are owned by root
+	err = cfg.runAs.chownAll(dir)
 	if err != nil {
 		return nil, err
 	}
 
-	shouldKillPostgres := true
-	defer func() {
-		if shouldKillPostgres {
-			proc.Process.Kill()
-		}
-	}()
-
-	currentUser, err := user.Current()
+	superuser, err := cfg.runAs.superuserName()
 	if err != nil {
 		return nil, err
 	}
 	password := ""
-	if options.InsecureGlobalPort != 0 {
-		passwordBytes := make([]byte, 8)
-		_, err = cryptorand.Reader.Read(passwordBytes)
+	if options.usesPassword() {
+		password, err = randomHex(8)
 		if err != nil {
 			return nil, err
 		}
-		password = hex.EncodeToString(passwordBytes)
 	}
 
-	instance := &Instance{proc, cfg, dir, options.InsecureGlobalPort, currentUser.Username, password}
-
-	// poll for the socket to be created
-	const maxPolls = 40
-	const pollSleep = 10 * time.Millisecond
-	started := false
-	for i := 0; i < maxPolls; i++ {
-		time.Sleep(pollSleep)
-
-		_, err = os.Stat(instance.socketPath())
-		if err == nil {
-			started = true
-			break
-		}
-		if !os.IsNotExist(err) {
+	var ownerLock *os.File
+	if temporary {
+		ownerLock, err = createOwnerLock(dir)
+		if err != nil {
 			return nil, err
 		}
 	}
-	if !started {
-		return nil, errors.New("postgrestest: failed to find UNIX socket: " + instance.socketPath())
-	}
 
-	// poll until the server is not failing connections with "starting up"
-	err = connectUntilReady(instance.socketPath())
+	instance := &Instance{
+		cfg:          cfg,
+		dbDir:        dir,
+		globalPort:   options.InsecureGlobalPort,
+		username:     superuser,
+		password:     password,
+		log:          serverLog,
+		tlsCACertPEM: tlsCACertPEM,
+		options:      options,
+		ownerLock:    ownerLock,
+	}
+	err = instance.startServer(ctx, logFile)
 	if err != nil {
+		instance.ownerLock.Close()
 		return nil, err
 	}
 
-	if options.InsecureGlobalPort != 0 {
+	shouldKillPostgres := true
+	defer func() {
+		if shouldKillPostgres {
+			// kill any backends it started, and wait so it no longer uses the directory or port
+			syscall.Kill(-instance.proc.cmd.Process.Pid, syscall.SIGKILL)
+			instance.proc.wait()
+			instance.ownerLock.Close()
+		}
+	}()
+
+	if options.usesPassword() {
 		// this adds a pgx dependency which we already use for the test anyway
-		// TODO: remove connectUntilReady and replace with pgx
-		ctx := context.Background()
-		conn, err := pgx.Connect(ctx, instance.LocalhostURL())
+		conn, err := pgx.Connect(ctx, instance.URL())
 		if err != nil {
 			return nil, err
 		}
@@ -253,16 +441,146 @@ func NewInstanceWithOptions(options Options) (*Instance, error) {
 		}
 	}
 
-	shouldCleanUpDir = false
+	// template1 is copied by CREATE DATABASE, so new databases will also have the extensions
+	for _, extension := range options.extensions() {
+		statement := "CREATE EXTENSION IF NOT EXISTS " + doubleQuoteIdentifier(extension)
+		for _, dbName := range []string{"template1", defaultDatabase} {
+			err = instance.execSQL(ctx, dbName, statement)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if options.QueryStats != nil {
+		// only report the statements executed by the caller
+		err = instance.ResetQueryStats(ctx)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	shouldKillPostgres = false
 	return instance, err
 }
 
+// startServer starts postgres and waits until it accepts connections. If logFile is not nil, the
+// output is written to it. Otherwise, it is captured by the Instance's serverLog. Postgres is
+// started in a new process group, so it can continue running after this process exits, and so
+// signals can be sent to all its processes.
+func (i *Instance) startServer(ctx context.Context, logFile *os.File) error {
+	// By default Postgres puts its Unix-domain socket in /tmp; "-k ." puts it in the data dir.
+	// however, then on Mac OS X we get "socket name too long" because the absolute path to the
+	// socket can't exceed 100 characters
+	postgresPath := i.cfg.binPath("postgres")
+
+	// default for Postgres with no arguments: listen on localhost
+	// -h "": do not listen for TCP
+	// -h "*": listen on all addresses
+	options := i.options
+	args := []string{"-D", i.dbDir, "-k", "."}
+	listenOnLocalhost := options.ListenOnLocalhost || (options.TLS && options.InsecureGlobalPort == 0)
+	if !listenOnLocalhost {
+		if options.InsecureGlobalPort == 0 {
+			args = append(args, "-h", "")
+		} else {
+			args = append(args, "-h", "*", "-p", strconv.Itoa(options.InsecureGlobalPort))
+		}
+	}
+	args = append(args, serverConfigArgs(options)...)
+	var output io.Writer = logFile
+	var procLog *serverLog
+	if logFile == nil {
+		output = i.log.writer("postgres")
+		procLog = i.log
+	}
+	cmd := commandWithOutput(options.Logger, output, postgresPath, args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	i.cfg.runAs.setCredential(cmd)
+	proc, err := startServerProcess(cmd, procLog)
+	if err != nil {
+		return err
+	}
+
+	startupTimeout := options.StartupTimeout
+	if startupTimeout == 0 {
+		startupTimeout = defaultStartupTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, startupTimeout)
+	defer cancel()
+	err = waitUntilReady(ctx, i.socketPath(), i.username, proc)
+	if err != nil {
+		// kill any backends it started, and wait so it no longer uses the directory or port
+		syscall.Kill(-proc.cmd.Process.Pid, syscall.SIGKILL)
+		proc.wait()
+		return err
+	}
+	i.proc = proc
+	return nil
+}
+
+// serverConfigArgs returns the "-c name=value" arguments to configure postgres. The settings are
+// sorted by name so the command line is deterministic.
+func serverConfigArgs(options Options) []string {
+	config := map[string]string{}
+	if options.TLS {
+		config["ssl"] = "on"
+	}
+	if options.FastUnsafe {
+		config["fsync"] = "off"
+		config["synchronous_commit"] = "off"
+		config["full_page_writes"] = "off"
+		config["min_wal_size"] = "32MB"
+		config["max_wal_size"] = "64MB"
+	}
+	if options.SharedBuffers != 0 {
+		config["shared_buffers"] = fmt.Sprintf("%dB", options.SharedBuffers)
+	}
+	sharedPreloadLibraries := options.sharedPreloadLibraries()
+	if len(sharedPreloadLibraries) != 0 {
+		config["shared_preload_libraries"] = strings.Join(sharedPreloadLibraries, ",")
+	}
+	if options.QueryStats != nil {
+		config["log_min_duration_statement"] = strconv.FormatInt(
+			options.QueryStats.logMinDuration().Milliseconds(), 10)
+	}
+	for name, value := range options.ServerConfig {
+		config[name] = value
+	}
+
+	names := maps.Keys(config)
+	slices.Sort(names)
+	var args []string
+	for _, name := range names {
+		args = append(args, "-c", name+"="+config[name])
+	}
+	return args
+}
+
+// randomHex returns numBytes random bytes encoded as a hex string.
+func randomHex(numBytes int) (string, error) {
+	randomBytes := make([]byte, numBytes)
+	_, err := cryptorand.Reader.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(randomBytes), nil
+}
+
 // https://www.postgresql.org/docs/current/sql-syntax-lexical.html#SQL-SYNTAX-IDENTIFIERS
 func doubleQuoteIdentifier(s string) string {
 	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
 }
 
+// ServerLog returns the most recent output from initdb and postgres. It returns the empty string for
+// a shared instance (see NewSharedInstance), which writes its output to a file.
+func (i *Instance) ServerLog() string {
+	if i.log == nil {
+		return ""
+	}
+	return i.log.String()
+}
+
 // BinPath returns the absolute path to commandName in the Postgres binary directory.
 func (i *Instance) BinPath(commandName string) string {
 	return i.cfg.binPath(commandName)
@@ -276,6 +594,10 @@ func logCMD(logger *slog.Logger, cmd *exec.Cmd) {
 // They also wrap psql with a Perl script to allow multiple versions to co-exist.
 type pgConfig struct {
 	path string
+	// output of pg_config --version e.g. "PostgreSQL 15.14"
+	version string
+	// if not nil, initdb and postgres run as this user because the current process is root
+	runAs *runAsUser
 }
 
 func readPGConfig(logger *slog.Logger) (*pgConfig, error) {
@@ -291,13 +613,59 @@ func readPGConfig(logger *slog.Logger) (*pgConfig, error) {
 		return nil, err
 	}
 	binPath := string(bytes.TrimSpace(out))
-	return &pgConfig{binPath}, nil
+
+	out, err = command(logger, configPath, "--version").Output()
+	if err != nil {
+		return nil, err
+	}
+	version := string(bytes.TrimSpace(out))
+	return &pgConfig{path: binPath, version: version}, nil
 }
 
 func (p *pgConfig) binPath(commandName string) string {
 	return filepath.Join(p.path, commandName)
 }
 
+// majorVersion returns the major version in the same format as the PG_VERSION file (e.g. "15").
+func (p *pgConfig) majorVersion() (string, error) {
+	// version is "PostgreSQL 15.14 (Debian 15.14-0+deb12u1)"; before 10 the major version was
+	// two numbers: "PostgreSQL 9.6.24"
+	fields := strings.Fields(p.version)
+	if len(fields) < 2 {
+		return "", fmt.Errorf("postgrestest: could not parse version=%#v", p.version)
+	}
+	parts := strings.Split(fields[1], ".")
+	major, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return "", fmt.Errorf("postgrestest: could not parse version=%#v: %w", p.version, err)
+	}
+	if major < 10 && len(parts) >= 2 {
+		return parts[0] + "." + parts[1], nil
+	}
+	return parts[0], nil
+}
+
+// isInitialized returns true if dir contains a Postgres data directory, or an error if it was
+// created by a different major version of Postgres.
+func isInitialized(dir string, cfg *pgConfig) (bool, error) {
+	dirVersion, err := os.ReadFile(filepath.Join(dir, pgVersionFileName))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	major, err := cfg.majorVersion()
+	if err != nil {
+		return false, err
+	}
+	if string(bytes.TrimSpace(dirVersion)) != major {
+		return false, fmt.Errorf("postgrestest: dir=%s was created by Postgres %s; incompatible with %s",
+			dir, string(bytes.TrimSpace(dirVersion)), cfg.version)
+	}
+	return true, nil
+}
+
 // command calls exec.Command and sets Env, and logs the command.
 func command(logger *slog.Logger, name string, arg ...string) *exec.Cmd {
 	cmd := exec.Command(name, arg...)
@@ -306,29 +674,36 @@ func command(logger *slog.Logger, name string, arg ...string) *exec.Cmd {
 	return cmd
 }
 
-// commandPassOutput calls command and sets Stdout and Stderr to os.Stdout and os.Stderr.
-func commandPassOutput(logger *slog.Logger, name string, arg ...string) *exec.Cmd {
+// commandWithOutput calls command and sets Stdout and Stderr to output.
+func commandWithOutput(logger *slog.Logger, output io.Writer, name string, arg ...string) *exec.Cmd {
 	cmd := command(logger, name, arg...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd.Stdout = output
+	cmd.Stderr = output
 	return cmd
 }
 
-func initializePostgresDir(dbDir string, logger *slog.Logger, cfg *pgConfig) error {
-	// Debian/Ubuntu: initdb is not in PATH; find it with pg_config
-	initDBPath := cfg.binPath("initdb")
-
+// initDBArgs returns the arguments for initdb, except for the data directory.
+func initDBArgs() []string {
 	// --locale-provider=icu: Use ICU instead of libc for locales
 	// --encoding=UTF8: Use UTF-8; don't rely on locale
 	// --no-sync: return without waiting for fsync
-	// --pgdata: specify cluster database
-	// --username: use postgres as the superuser (I believe this changed)
-	cmd := commandPassOutput(logger, initDBPath,
+	return []string{
 		"--locale-provider=icu",
 		"--encoding=UTF8",
 		"--icu-locale=und-x-icu",
 		"--no-sync",
-		"--pgdata="+dbDir)
+	}
+}
+
+func initializePostgresDir(dbDir string, logger *slog.Logger, cfg *pgConfig, output io.Writer) error {
+	// Debian/Ubuntu: initdb is not in PATH; find it with pg_config
+	initDBPath := cfg.binPath("initdb")
+
+	// --pgdata: specify cluster database
+	// --username: use postgres as the superuser (I believe this changed)
+	args := append(initDBArgs(), "--pgdata="+dbDir)
+	cmd := commandWithOutput(logger, output, initDBPath, args...)
+	cfg.runAs.setCredential(cmd)
 	return cmd.Run()
 }
 
@@ -339,8 +714,36 @@ func (i *Instance) socketPath() string {
 // URL returns the Postgres connection URL using a Unix socket in the form "postgresql://...". See:
 // https://www.postgresql.org/docs/current/libpq-connect.html#LIBPQ-CONNSTRING
 func (i *Instance) URL() string {
+	return i.URLForDatabase(defaultDatabase)
+}
+
+// URLForDatabase returns the Postgres connection URL for the database named dbName, using a Unix
+// socket. See URL().
+func (i *Instance) URLForDatabase(dbName string) string {
 	// https://www.postgresql.org/docs/current/libpq-connect.html#LIBPQ-CONNSTRING
-	return "postgresql:///postgres?host=" + i.dbDir + "&port=" + strconv.Itoa(i.port())
+	userInfo := ""
+	if i.cfg.runAs != nil {
+		// the superuser is not the current OS user, which is the default
+		userInfo = url.User(i.username).String() + "@"
+	}
+	return "postgresql://" + userInfo + "/" + url.PathEscape(dbName) + "?host=" + i.dbDir +
+		"&port=" + strconv.Itoa(i.port())
+}
+
+// execSQL connects to the database named dbName, executes each statement, then disconnects.
+func (i *Instance) execSQL(ctx context.Context, dbName string, statements ...string) error {
+	conn, err := pgx.Connect(ctx, i.URLForDatabase(dbName))
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+	for _, statement := range statements {
+		_, err = conn.Exec(ctx, statement)
+		if err != nil {
+			return err
+		}
+	}
+	return conn.Close(ctx)
 }
 
 func (i *Instance) port() int {
@@ -354,7 +757,12 @@ func (i *Instance) port() int {
 // work if using Options.ListenOnLocalhost=true. Most callers should use URL() instead.
 func (i *Instance) LocalhostURL() string {
 	// https://www.postgresql.org/docs/current/libpq-connect.html#LIBPQ-CONNSTRING
-	return fmt.Sprintf("postgresql://127.0.0.1:%d/postgres", i.port())
+	userInfo := ""
+	if i.cfg.runAs != nil {
+		// the superuser is not the current OS user, which is the default
+		userInfo = url.User(i.username).String() + "@"
+	}
+	return fmt.Sprintf("postgresql://%s127.0.0.1:%d/postgres", userInfo, i.port())
 }
 
 // RemoteURL returns the first Postgres connection URL using an IP address that is not localhost.
@@ -376,166 +784,96 @@ func (i *Instance) RemoteURL() string {
 	return i.RemoteURLForAddress("127.0.0.1")
 }
 
+// TLSURL returns the Postgres connection URL using TLS to localhost, with the password. The
+// connection verifies the server certificate using the CA certificate from TLSCACertPath(). This
+// will only work if using Options.TLS.
+func (i *Instance) TLSURL() string {
+	return fmt.Sprintf("postgresql://%s:%s@%s/postgres?sslmode=verify-full&sslrootcert=%s",
+		url.PathEscape(i.username), url.PathEscape(i.password),
+		net.JoinHostPort("localhost", strconv.Itoa(i.port())), url.QueryEscape(i.TLSCACertPath()))
+}
+
+// TLSCACertPath returns the path to the CA certificate file in PEM format when using Options.TLS.
+func (i *Instance) TLSCACertPath() string {
+	return filepath.Join(i.dbDir, tlsCACertFileName)
+}
+
+// TLSCACertPEM returns the CA certificate in PEM format when using Options.TLS, or nil.
+func (i *Instance) TLSCACertPEM() []byte {
+	return i.tlsCACertPEM
+}
+
 func (i *Instance) RemoteURLForAddress(address string) string {
 	return fmt.Sprintf("postgresql://%s:%s@%s/postgres",
 		i.username, i.password, net.JoinHostPort(address, strconv.Itoa(i.port())))
 }
 
-// Close shuts down Postgres and deletes the temporary directory.
+// Close shuts down Postgres and deletes the temporary directory. If the instance is shared, it
+// is only shut down if no other process is using it.
 func (i *Instance) Close() error {
 	// allow calling Close() multiple times
+	if i.shared != nil {
+		shared := i.shared
+		i.shared = nil
+		proc := i.proc
+		i.proc = nil
+		return shared.release(i.dbDir, proc)
+	}
 	if i.proc == nil {
 		return nil
 	}
 	proc := i.proc
 	i.proc = nil
 
-	// SIGQUIT = immediate shutdown: terminates all child processes and sends kill within 5 seconds
-	// https://www.postgresql.org/docs/14/server-shutdown.html
-	err := proc.Process.Signal(syscall.SIGQUIT)
-	if err != nil {
+	// the process exited if Restart or Crash failed to start it again: only delete the directory
+	var err error
+	if !proc.exited() {
+		// SIGQUIT = immediate shutdown: terminates all child processes and sends kill within 5
+		// seconds. https://www.postgresql.org/docs/14/server-shutdown.html
+		err = proc.cmd.Process.Signal(syscall.SIGQUIT)
+		if err == nil {
+			err = proc.wait()
+		}
+	}
+	if i.keepDir {
 		return err
 	}
-	err = proc.Wait()
 	err2 := os.RemoveAll(i.dbDir)
+	// release the lock after deleting the directory, so Reap does not try to delete it
+	i.ownerLock.Close()
 	if err != nil {
 		return err
 	}
 	return err2
 }
 
-// See cannot_connect_now and ERRCODE_CANNOT_CONNECT_NOW:
-// https://www.postgresql.org/docs/14/errcodes-appendix.html
-// https://github.com/postgres/postgres/blob/master/src/backend/postmaster/postmaster.c
-//
-// Encoded as ErrorResponse field type 'C' SQLSTATE code followed by NUL terminated string
-const cannotConnectErrCode = "C57P03\x00"
-
-const msgErrKind = 'E'
-
-// connectUntilReady polls the socket until it stops returning "the database system is starting up"
-func connectUntilReady(unixSocketPath string) error {
-	// this does this the hard way to avoid direct dependencies on DB drivers
-	// this is probably stupid, but means users can use whatever driver they want, or none at all
-
-	// connect to socket and see if the DB is ready
-	const maxAttempts = 40
-	const attemptSleep = 10 * time.Millisecond
-	for i := 0; i < maxAttempts; i++ {
-		// Connect to the socket
-		clientConn, err := net.Dial("unix", unixSocketPath)
-		if err != nil {
-			return err
-		}
-		err = writeStartupMessage(clientConn)
-		if err != nil {
-			return err
-		}
-
-		// read the response
-		msg, err := readMessage(clientConn)
-		if err != nil {
-			return err
+// SQLSTATE returned while Postgres is starting up, shutting down, or in crash recovery. See:
+// https://www.postgresql.org/docs/current/errcodes-appendix.html
+const cannotConnectNowCode = "57P03"
+
+// checkReady connects to the socket as user and returns true if Postgres is accepting
+// connections. It returns false if the socket does not exist yet, or if Postgres is "starting up".
+// If Postgres rejects the connection for any other reason, it returns the error it sent.
+func checkReady(ctx context.Context, unixSocketPath string, user string) (bool, error) {
+	// this uses pgwire to avoid direct dependencies on DB drivers, so users can use whatever
+	// driver they want, or none at all
+	conn, err := pgwire.Connect(ctx, pgwire.Config{
+		Network:  "unix",
+		Address:  unixSocketPath,
+		User:     user,
+		Database: defaultDatabase,
+	})
+	if err != nil {
+		if errors.Is(err, syscall.ENOENT) || errors.Is(err, syscall.ECONNREFUSED) {
+			// the socket is not created or not listening yet
+			return false, nil
 		}
-
-		// close the connection
-		err = clientConn.Close()
-		if err != nil {
-			return err
+		var pgErr *pgwire.Error
+		if errors.As(err, &pgErr) && pgErr.Code == cannotConnectNowCode {
+			// wait and try again
+			return false, nil
 		}
-
-		if msg.kind == msgErrKind && bytes.Contains(msg.body, []byte(cannotConnectErrCode)) {
-			// this is the "cannot connect" error: wait and try again
-			time.Sleep(attemptSleep)
-			continue
-		}
-
-		// some other response! Assume success, or the driver will report the error
-		return nil
+		return false, err
 	}
-
-	// we are still getting "cannot connect": report the error elsewhere
-	return nil
+	return true, conn.Close()
 }
-
-func writeStartupMessage(w io.Writer) error {
-	// See StartupMessage
-	// https://www.postgresql.org/docs/14/protocol-message-formats.html
-	// StartupMessage
-
-	var msg bytes.Buffer
-	const protocolMajor = 3
-	const protocolMinor = 0
-	protocol := int32(protocolMajor<<16 | protocolMinor)
-	writeI32(&msg, protocol)
-
-	// write the key/value parameters: user is required
-	writeString(&msg, "user")
-	writeString(&msg, "postgres")
-
-	// "A zero byte is required as a terminator after the last name/value pair"
-	msg.WriteByte(0x00)
-
-	// add the length prefix in front of this message
-	msgLen := msg.Len() + 4
-	var outerMsg bytes.Buffer
-	writeI32(&outerMsg, int32(msgLen))
-	_, err := msg.WriteTo(&outerMsg)
-	if err != nil {
-		panic(err)
-	}
-
-	// write the entire packet
-	_, err = outerMsg.WriteTo(w)
-	return err
-}
-
-type message struct {
-	kind byte
-	body []byte
-}
-
-// readMessage
-func readMessage(r io.Reader) (*message, error) {
-	// read the kind and length
-	buf := make([]byte, 1024)
-	_, err := io.ReadFull(r, buf[:5])
-	if err != nil {
-		return nil, err
-	}
-
-	kind := buf[0]
-	// msgLen includes self
-	msgLen := int32(binary.BigEndian.Uint32(buf[1:5])) - 4
-	if msgLen < 0 || int(msgLen) > len(buf) {
-		return nil, fmt.Errorf("msgLen=%d out of bounds", msgLen)
-	}
-	_, err = io.ReadFull(r, buf[:msgLen])
-	if err != nil {
-		return nil, err
-	}
-	return &message{kind, buf[:msgLen]}, nil
-}
-
-func writeI32(w io.Writer, v int32) {
-	var buf [4]byte
-	binary.BigEndian.PutUint32(buf[:], uint32(v))
-	_, err := w.Write(buf[:])
-	if err != nil {
-		panic(err)
-	}
-}
-
-func writeString(w io.Writer, s string) {
-	// null terminated C string
-	_, err := w.Write([]byte(s))
-	if err != nil {
-		panic(err)
-	}
-	_, err = w.Write([]byte{0x00})
-	if err != nil {
-		panic(err)
-	}
-}
-
-// https://www.postgresql.org/docs/14/protocol-flow.html#id-1.10.5.7.3
@@ -13,6 +13,7 @@ import (
 	"time"
 
 	"github.com/jackc/pgx/v5"
+	"golang.org/x/exp/slices"
 	"golang.org/x/exp/slog"
 )
 
@@ -93,7 +94,7 @@ func TestNewInstance(t *testing.T) {
 }
 
 func TestNewInstanceWithLocalhostOptions(t *testing.T) {
-	instance, err := NewInstanceWithOptions(Options{ListenOnLocalhost: true})
+	instance, err := NewInstanceWithOptions(context.Background(), Options{ListenOnLocalhost: true})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -137,7 +138,7 @@ func TestNewInstanceWithLocalhostOptions(t *testing.T) {
 }
 
 func TestNewInstanceWithGlobalOption(t *testing.T) {
-	instance, err := NewInstanceWithOptions(Options{
+	instance, err := NewInstanceWithOptions(context.Background(), Options{
 		Logger:             slog.Default(),
 		InsecureGlobalPort: 12345,
 	})
@@ -218,21 +219,22 @@ func TestNewInstanceWithGlobalOption(t *testing.T) {
 }
 
 func TestNewInstanceWithOptionsError(t *testing.T) {
-	instance, err := NewInstanceWithOptions(Options{ListenOnLocalhost: true, InsecureGlobalPort: 12345})
+	instance, err := NewInstanceWithOptions(context.Background(),
+		Options{ListenOnLocalhost: true, InsecureGlobalPort: 12345})
 	if instance != nil {
 		t.Error(instance)
 	}
 	if !strings.Contains(err.Error(), "cannot set both") {
 		t.Error(err)
 	}
-	instance, err = NewInstanceWithOptions(Options{InsecureGlobalPort: -1})
+	instance, err = NewInstanceWithOptions(context.Background(), Options{InsecureGlobalPort: -1})
 	if instance != nil {
 		t.Error(instance)
 	}
 	if !strings.Contains(err.Error(), "invalid GlobalPort") {
 		t.Error(err)
 	}
-	instance, err = NewInstanceWithOptions(Options{InsecureGlobalPort: 1 << 16})
+	instance, err = NewInstanceWithOptions(context.Background(), Options{InsecureGlobalPort: 1 << 16})
 	if instance != nil {
 		t.Error(instance)
 	}
@@ -242,7 +244,7 @@ func TestNewInstanceWithOptionsError(t *testing.T) {
 }
 
 func TestNewInstanceWithOptionsSharedBuffers(t *testing.T) {
-	instance, err := NewInstanceWithOptions(Options{SharedBuffers: 256 << 20})
+	instance, err := NewInstanceWithOptions(context.Background(), Options{SharedBuffers: 256 << 20})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -266,11 +268,21 @@ func TestNewInstanceWithOptionsSharedBuffers(t *testing.T) {
 }
 
 func TestNewInstanceWithOptionsDirPath(t *testing.T) {
-	tempDir := t.TempDir()
+	// not t.TempDir(): when running as root, the unprivileged user must be able to access the
+	// parent directories (see Options.UnprivilegedUser)
+	tempDir, err := os.MkdirTemp("", "dirpath_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	err = os.Chmod(tempDir, 0711)
+	if err != nil {
+		t.Fatal(err)
+	}
 	pgDirPath := filepath.Join(tempDir, "pg_dir")
 
 	options := Options{DirPath: pgDirPath}
-	instance, err := NewInstanceWithOptions(options)
+	instance, err := NewInstanceWithOptions(context.Background(), options)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -296,11 +308,202 @@ func TestNewInstanceWithOptionsDirPath(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	// the directory must not be deleted
+	_, err = os.Stat(filepath.Join(pgDirPath, pgVersionFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	// reuse the directory: table must exist
-	instance2, err := NewInstanceWithOptions(options)
+	instance2, err := NewInstanceWithOptions(context.Background(), options)
 	if err != nil {
 		t.Fatal(err)
 	}
 	defer instance2.Close()
+	conn, err = pgx.Connect(ctx, instance2.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(ctx)
+	var count int
+	err = conn.QueryRow(ctx, `SELECT COUNT(*) FROM example`).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("expected count=0; was %d", count)
+	}
+}
+
+func TestNewInstanceWithOptionsDirPathVersionMismatch(t *testing.T) {
+	pgDirPath := t.TempDir()
+	err := os.WriteFile(filepath.Join(pgDirPath, pgVersionFileName), []byte("9.6\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	instance, err := NewInstanceWithOptions(context.Background(), Options{DirPath: pgDirPath})
+	if instance != nil {
+		t.Error(instance)
+	}
+	if err == nil || !strings.Contains(err.Error(), "was created by Postgres 9.6") {
+		t.Errorf("expected version mismatch error; err=%v", err)
+	}
+}
+
+func TestMajorVersion(t *testing.T) {
+	for _, test := range []struct {
+		version  string
+		expected string
+	}{
+		{"PostgreSQL 15.14 (Debian 15.14-0+deb12u1)", "15"},
+		{"PostgreSQL 16.0", "16"},
+		{"PostgreSQL 9.6.24", "9.6"},
+	} {
+		cfg := &pgConfig{version: test.version}
+		major, err := cfg.majorVersion()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if major != test.expected {
+			t.Errorf("majorVersion(%#v)=%#v; expected %#v", test.version, major, test.expected)
+		}
+	}
+
+	cfg := &pgConfig{version: "invalid"}
+	_, err := cfg.majorVersion()
+	if err == nil {
+		t.Error("expected error for invalid version")
+	}
+}
+
+func TestServerConfigArgs(t *testing.T) {
+	args := serverConfigArgs(Options{
+		SharedBuffers:          1 << 20,
+		SharedPreloadLibraries: []string{"pg_stat_statements", "auto_explain"},
+		ServerConfig:           map[string]string{"work_mem": "8MB", "shared_buffers": "2MB"},
+	})
+	expected := []string{
+		"-c", "shared_buffers=2MB",
+		"-c", "shared_preload_libraries=pg_stat_statements,auto_explain",
+		"-c", "work_mem=8MB",
+	}
+	if !slices.Equal(args, expected) {
+		t.Errorf("serverConfigArgs=%#v; expected %#v", args, expected)
+	}
+}
 
+func TestNewInstanceWithOptionsServerConfig(t *testing.T) {
+	instance, err := NewInstanceWithOptions(context.Background(), Options{
+		ServerConfig:           map[string]string{"log_statement": "all"},
+		SharedPreloadLibraries: []string{"pg_stat_statements"},
+		Extensions:             []string{"pg_stat_statements"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instance.Close()
+
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, instance.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(ctx)
+
+	var logStatement string
+	err = conn.QueryRow(ctx, `SHOW log_statement`).Scan(&logStatement)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if logStatement != "all" {
+		t.Errorf("expected log_statement=all; was %s", logStatement)
+	}
+
+	// the extension must be loaded and created
+	var count int
+	err = conn.QueryRow(ctx, `SELECT COUNT(*) FROM pg_stat_statements`).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewInstanceWithOptionsFastUnsafe(t *testing.T) {
+	instance, err := NewInstanceWithOptions(context.Background(), Options{FastUnsafe: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instance.Close()
+
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, instance.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(ctx)
+	var fsync string
+	err = conn.QueryRow(ctx, `SHOW fsync`).Scan(&fsync)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fsync != "off" {
+		t.Errorf("expected fsync=off; was %s", fsync)
+	}
+}
+
+var benchmarkOptions = []struct {
+	name    string
+	options Options
+}{
+	{"default", Options{}},
+	{"fast_unsafe", Options{FastUnsafe: true}},
+}
+
+func BenchmarkStartup(b *testing.B) {
+	for _, benchmark := range benchmarkOptions {
+		b.Run(benchmark.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				instance, err := NewInstanceWithOptions(context.Background(), benchmark.options)
+				if err != nil {
+					b.Fatal(err)
+				}
+				err = instance.Close()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkInsert(b *testing.B) {
+	for _, benchmark := range benchmarkOptions {
+		b.Run(benchmark.name, func(b *testing.B) {
+			instance, err := NewInstanceWithOptions(context.Background(), benchmark.options)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer instance.Close()
+
+			ctx := context.Background()
+			conn, err := pgx.Connect(ctx, instance.URL())
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close(ctx)
+			_, err = conn.Exec(ctx, `CREATE TABLE example (id INTEGER PRIMARY KEY, value TEXT)`)
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			// each insert is its own transaction, so this measures the cost of commits
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err = conn.Exec(ctx, `INSERT INTO example VALUES ($1, 'value')`, i)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
 }
@@ -0,0 +1,223 @@
+package postgrestest
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jackc/pgx/v5"
+	"golang.org/x/exp/slices"
+)
+
+// the extension used by Options.QueryStats
+const pgStatStatements = "pg_stat_statements"
+
+// default for QueryStatsOptions.TopN
+const defaultQueryStatsTopN = 10
+
+// default for QueryStatsOptions.LogMinDuration
+const defaultLogMinDuration = 100 * time.Millisecond
+
+// statements in the report are truncated to this many bytes
+const maxReportQueryLength = 200
+
+// QueryStatsOptions configures the statistics collected with Options.QueryStats. The budgets
+// MaxDuration and MaxCalls can find performance regressions in unit tests, such as N+1 queries
+// that execute one statement per row.
+type QueryStatsOptions struct {
+	// Number of statements to report, ordered by total time and by number of calls. If 0, the
+	// default is 10.
+	TopN int
+
+	// Postgres logs statements that take at least this long with log_min_duration_statement. If
+	// 0, the default is 100 milliseconds.
+	LogMinDuration time.Duration
+
+	// If not 0, NewWithOptions fails the test if any execution of a statement took longer.
+	MaxDuration time.Duration
+
+	// If not 0, NewWithOptions fails the test if any statement was executed more times.
+	MaxCalls int64
+}
+
+func (o *QueryStatsOptions) topN() int {
+	if o.TopN == 0 {
+		return defaultQueryStatsTopN
+	}
+	return o.TopN
+}
+
+func (o *QueryStatsOptions) logMinDuration() time.Duration {
+	if o.LogMinDuration == 0 {
+		return defaultLogMinDuration
+	}
+	return o.LogMinDuration
+}
+
+// sharedPreloadLibraries returns SharedPreloadLibraries, including pg_stat_statements if needed.
+func (o Options) sharedPreloadLibraries() []string {
+	if o.QueryStats == nil || slices.Contains(o.SharedPreloadLibraries, pgStatStatements) {
+		return o.SharedPreloadLibraries
+	}
+	return append(slices.Clone(o.SharedPreloadLibraries), pgStatStatements)
+}
+
+// extensions returns Extensions, including pg_stat_statements if needed.
+func (o Options) extensions() []string {
+	if o.QueryStats == nil || slices.Contains(o.Extensions, pgStatStatements) {
+		return o.Extensions
+	}
+	return append(slices.Clone(o.Extensions), pgStatStatements)
+}
+
+// StatementStats contains the statistics for one statement from pg_stat_statements. See:
+// https://www.postgresql.org/docs/current/pgstatstatements.html
+type StatementStats struct {
+	// The statement text, with constants replaced by parameters like $1.
+	Query string
+	// Number of times the statement was executed.
+	Calls int64
+	// Total number of rows returned or affected.
+	Rows int64
+	// Total time spent executing the statement.
+	TotalTime time.Duration
+	// Mean time spent executing the statement.
+	MeanTime time.Duration
+	// Maximum time spent executing the statement once.
+	MaxTime time.Duration
+}
+
+// QueryStats returns the statistics for all statements executed in all databases since the
+// instance started, or since ResetQueryStats was called, ordered by total time. It requires
+// Options.QueryStats.
+func (i *Instance) QueryStats(ctx context.Context) ([]StatementStats, error) {
+	if i.options.QueryStats == nil {
+		return nil, fmt.Errorf("postgrestest: QueryStats requires Options.QueryStats")
+	}
+	conn, err := pgx.Connect(ctx, i.URL())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close(ctx)
+
+	// times are in milliseconds; the _exec_ columns were added in Postgres 13
+	rows, err := conn.Query(ctx, `SELECT query, calls, rows,
+			total_exec_time, mean_exec_time, max_exec_time
+		FROM pg_stat_statements
+		ORDER BY total_exec_time DESC, query`)
+	if err != nil {
+		return nil, err
+	}
+	var stats []StatementStats
+	for rows.Next() {
+		var s StatementStats
+		var totalMillis, meanMillis, maxMillis float64
+		err = rows.Scan(&s.Query, &s.Calls, &s.Rows, &totalMillis, &meanMillis, &maxMillis)
+		if err != nil {
+			return nil, err
+		}
+		s.TotalTime = millisToDuration(totalMillis)
+		s.MeanTime = millisToDuration(meanMillis)
+		s.MaxTime = millisToDuration(maxMillis)
+		stats = append(stats, s)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, err
+	}
+	return stats, conn.Close(ctx)
+}
+
+// ResetQueryStats discards the statistics returned by QueryStats. Tests can call it after setup,
+// so only the statements executed by the code being tested are reported.
+func (i *Instance) ResetQueryStats(ctx context.Context) error {
+	if i.options.QueryStats == nil {
+		return fmt.Errorf("postgrestest: ResetQueryStats requires Options.QueryStats")
+	}
+	return i.execSQL(ctx, defaultDatabase, `SELECT pg_stat_statements_reset()`)
+}
+
+func millisToDuration(millis float64) time.Duration {
+	return time.Duration(millis * float64(time.Millisecond))
+}
+
+// reportQueryStats logs the top statements from instance, and fails the test if any statement is
+// over the budgets in options.
+func reportQueryStats(t testing.TB, instance *Instance, options *QueryStatsOptions) {
+	stats, err := instance.QueryStats(context.Background())
+	if err != nil {
+		t.Errorf("failed reading query statistics: %s", err.Error())
+		return
+	}
+	t.Log(formatQueryStats(stats, options.topN()))
+	for _, violation := range queryStatsViolations(stats, options) {
+		t.Error(violation)
+	}
+}
+
+// formatQueryStats returns a report of the topN statements by total time and by calls.
+func formatQueryStats(stats []StatementStats, topN int) string {
+	var report strings.Builder
+	byTotalTime := slices.Clone(stats)
+	slices.SortStableFunc(byTotalTime, func(a StatementStats, b StatementStats) int {
+		return cmp.Compare(b.TotalTime, a.TotalTime)
+	})
+	byCalls := slices.Clone(stats)
+	slices.SortStableFunc(byCalls, func(a StatementStats, b StatementStats) int {
+		return cmp.Compare(b.Calls, a.Calls)
+	})
+
+	for _, section := range []struct {
+		title string
+		stats []StatementStats
+	}{
+		{"total time", byTotalTime},
+		{"calls", byCalls},
+	} {
+		fmt.Fprintf(&report, "postgres top %d statements by %s:\n", topN, section.title)
+		if len(section.stats) > topN {
+			section.stats = section.stats[:topN]
+		}
+		for _, s := range section.stats {
+			fmt.Fprintf(&report, "  total=%s calls=%d mean=%s max=%s rows=%d: %s\n",
+				s.TotalTime, s.Calls, s.MeanTime, s.MaxTime, s.Rows, truncateQuery(s.Query))
+		}
+	}
+	return report.String()
+}
+
+// truncateQuery returns query on a single line, truncated to at most maxReportQueryLength bytes
+// without splitting a UTF-8 character.
+func truncateQuery(query string) string {
+	query = strings.Join(strings.Fields(query), " ")
+	if len(query) > maxReportQueryLength {
+		end := maxReportQueryLength
+		for end > 0 && !utf8.RuneStart(query[end]) {
+			end--
+		}
+		query = query[:end] + "..."
+	}
+	return query
+}
+
+// queryStatsViolations returns a message for each statement that is over the budgets in options.
+func queryStatsViolations(stats []StatementStats, options *QueryStatsOptions) []string {
+	var violations []string
+	for _, s := range stats {
+		if options.MaxDuration != 0 && s.MaxTime > options.MaxDuration {
+			violations = append(violations, fmt.Sprintf(
+				"postgres statement took max=%s; MaxDuration=%s: %s",
+				s.MaxTime, options.MaxDuration, truncateQuery(s.Query)))
+		}
+		if options.MaxCalls != 0 && s.Calls > options.MaxCalls {
+			violations = append(violations, fmt.Sprintf(
+				"postgres statement executed calls=%d; MaxCalls=%d: %s",
+				s.Calls, options.MaxCalls, truncateQuery(s.Query)))
+		}
+	}
+	return violations
+}
@@ -0,0 +1,141 @@
+package postgrestest
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/exp/slices"
+)
+
+func TestQueryStatsOptions(t *testing.T) {
+	options := Options{
+		SharedPreloadLibraries: []string{"auto_explain"},
+		QueryStats:             &QueryStatsOptions{LogMinDuration: 5 * time.Millisecond},
+	}
+	args := serverConfigArgs(options)
+	expected := []string{
+		"-c", "log_min_duration_statement=5",
+		"-c", "shared_preload_libraries=auto_explain,pg_stat_statements",
+	}
+	if !slices.Equal(args, expected) {
+		t.Errorf("serverConfigArgs=%#v; expected %#v", args, expected)
+	}
+	if !slices.Equal(options.extensions(), []string{pgStatStatements}) {
+		t.Errorf("unexpected extensions=%#v", options.extensions())
+	}
+	// must not modify the options
+	if len(options.SharedPreloadLibraries) != 1 {
+		t.Errorf("SharedPreloadLibraries was modified: %#v", options.SharedPreloadLibraries)
+	}
+}
+
+func TestFormatQueryStats(t *testing.T) {
+	stats := []StatementStats{
+		{Query: "SELECT slow", Calls: 1, TotalTime: time.Second, MaxTime: time.Second},
+		{Query: "SELECT\n  many", Calls: 100, TotalTime: 10 * time.Millisecond, MaxTime: time.Millisecond},
+		{Query: "SELECT other", Calls: 2, TotalTime: time.Millisecond, MaxTime: time.Millisecond},
+	}
+	report := formatQueryStats(stats, 2)
+	expected := `postgres top 2 statements by total time:
+  total=1s calls=1 mean=0s max=1s rows=0: SELECT slow
+  total=10ms calls=100 mean=0s max=1ms rows=0: SELECT many
+postgres top 2 statements by calls:
+  total=10ms calls=100 mean=0s max=1ms rows=0: SELECT many
+  total=1ms calls=2 mean=0s max=1ms rows=0: SELECT other
+`
+	if report != expected {
+		t.Errorf("unexpected report:\n%s\nexpected:\n%s", report, expected)
+	}
+
+	violations := queryStatsViolations(stats, &QueryStatsOptions{
+		MaxDuration: 100 * time.Millisecond, MaxCalls: 10})
+	if len(violations) != 2 || !strings.Contains(violations[0], "SELECT slow") ||
+		!strings.Contains(violations[1], "SELECT many") {
+		t.Errorf("unexpected violations: %#v", violations)
+	}
+	violations = queryStatsViolations(stats, &QueryStatsOptions{})
+	if len(violations) != 0 {
+		t.Errorf("budgets of 0 must be disabled: %#v", violations)
+	}
+}
+
+func TestTruncateQuery(t *testing.T) {
+	if truncateQuery("SELECT\n\t1") != "SELECT 1" {
+		t.Errorf("truncateQuery must join lines: %#v", truncateQuery("SELECT\n\t1"))
+	}
+	// 'é' is 2 bytes: the limit falls in the middle of one
+	query := "SELECT 'a" + strings.Repeat("é", maxReportQueryLength) + "'"
+	truncated := truncateQuery(query)
+	if !utf8.ValidString(truncated) {
+		t.Errorf("truncateQuery must return valid UTF-8: %#v", truncated)
+	}
+	if !strings.HasSuffix(truncated, "...") || len(truncated) > maxReportQueryLength+len("...") {
+		t.Errorf("truncateQuery returned len=%d: %#v", len(truncated), truncated)
+	}
+}
+
+func TestQueryStats(t *testing.T) {
+	instance, err := NewInstanceWithOptions(context.Background(), Options{
+		QueryStats: &QueryStatsOptions{},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instance.Close()
+
+	// statements executed by NewInstanceWithOptions are not included
+	ctx := context.Background()
+	stats, err := instance.QueryStats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range stats {
+		if strings.Contains(s.Query, "CREATE EXTENSION") {
+			t.Errorf("statistics must be reset after startup: %#v", s)
+		}
+	}
+
+	// an N+1 query pattern
+	statements := []string{`CREATE TABLE example (id INTEGER PRIMARY KEY)`}
+	for i := 0; i < 5; i++ {
+		statements = append(statements, `INSERT INTO example VALUES (`+strconv.Itoa(i)+`)`)
+	}
+	err = instance.execSQL(ctx, defaultDatabase, statements...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err = instance.QueryStats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, s := range stats {
+		if strings.HasPrefix(s.Query, "INSERT INTO example") {
+			found = true
+			if s.Calls != 5 || s.Rows != 5 {
+				t.Errorf("expected calls=5 rows=5 for the normalized INSERT: %#v", s)
+			}
+		}
+	}
+	if !found {
+		t.Errorf("INSERT not found in stats: %#v", stats)
+	}
+
+	err = instance.ResetQueryStats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats, err = instance.QueryStats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range stats {
+		if strings.HasPrefix(s.Query, "INSERT") {
+			t.Errorf("statistics must be reset: %#v", s)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package postgrestest
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// prefix for temporary instance directories in os.TempDir() or memoryTempDir
+const tempDirPrefix = "postgrestest_"
+
+// written in each temporary instance directory with the owner's pid, and locked with flock by the
+// owner until it calls Close. The kernel releases the lock if the owner exits.
+const ownerLockFileName = "postgrestest.pid"
+
+// directories without an owner lock file that are newer than this may still be initializing
+const reapMinAge = time.Minute
+
+// createOwnerLock creates the owner lock file in dir, locks it, and writes this process's pid.
+func createOwnerLock(dir string) (*os.File, error) {
+	f, err := openLocked(filepath.Join(dir, ownerLockFileName), unix.LOCK_EX)
+	if err != nil {
+		return nil, err
+	}
+	// the file may have been copied from another instance by pg_basebackup
+	err = f.Truncate(0)
+	if err == nil {
+		_, err = f.WriteString(strconv.Itoa(os.Getpid()) + "\n")
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// ownerIsRunning returns true if the pid in dir's owner lock file is a running process.
+func ownerIsRunning(dir string) bool {
+	data, err := os.ReadFile(filepath.Join(dir, ownerLockFileName))
+	if err != nil {
+		return false
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return false
+	}
+	err = syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+// Reap finds temporary instances whose owner process exited without calling Close, for example
+// because a test binary was killed. It shuts down their Postgres servers, deletes their
+// directories, and returns the paths it deleted. Instances that are still in use are not changed.
+// It does not delete directories created with Options.DirPath, or the shared instance.
+func Reap() ([]string, error) {
+	parents := []string{os.TempDir()}
+	if memoryTempDir != os.TempDir() {
+		parents = append(parents, memoryTempDir)
+	}
+	return reapIn(parents)
+}
+
+// reapIn reaps the temporary instances in each directory in parents. It continues after errors,
+// and returns all of them.
+func reapIn(parents []string) ([]string, error) {
+	var reaped []string
+	var errs []error
+	for _, parent := range parents {
+		dirs, err := filepath.Glob(filepath.Join(parent, tempDirPrefix+"*"))
+		if err != nil {
+			return nil, err
+		}
+		for _, dir := range dirs {
+			deleted, err := reapDir(dir)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("postgrestest: failed reaping %s: %w", dir, err))
+			}
+			if deleted {
+				reaped = append(reaped, dir)
+			}
+		}
+	}
+	return reaped, errors.Join(errs...)
+}
+
+// reapDir deletes dir and shuts down its Postgres server if its owner has exited. It returns true
+// if it deleted dir.
+func reapDir(dir string) (bool, error) {
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		// deleted concurrently by the owner or another reaper
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !info.IsDir() {
+		return false, nil
+	}
+
+	ownerLock, err := os.OpenFile(filepath.Join(dir, ownerLockFileName), os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		// the owner creates the lock after initdb, so the directory may be initializing. Otherwise,
+		// the owner exited while initializing, or it was created by an older version.
+		if time.Since(info.ModTime()) < reapMinAge {
+			return false, nil
+		}
+	} else if err != nil {
+		return false, err
+	} else {
+		// hold the lock while deleting, so concurrent reapers skip it
+		defer ownerLock.Close()
+		err = unix.Flock(int(ownerLock.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+		if errors.Is(err, unix.EWOULDBLOCK) {
+			// the owner is still running
+			return false, nil
+		}
+		if err != nil {
+			return false, err
+		}
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			// the owner closed it after we opened the lock file
+			return false, nil
+		}
+		// pg_basebackup copies the primary's lock file to a replica before the replica's owner locks
+		// it; that owner is the same process as the primary's owner
+		if ownerIsRunning(dir) {
+			return false, nil
+		}
+	}
+
+	err = shutdownPostmaster(dir)
+	if err != nil {
+		return false, err
+	}
+	err = os.RemoveAll(dir)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
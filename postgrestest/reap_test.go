@@ -0,0 +1,111 @@
+package postgrestest
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReapIn(t *testing.T) {
+	parent := t.TempDir()
+	makeDir := func(name string) string {
+		dir := filepath.Join(parent, name)
+		err := os.Mkdir(dir, 0700)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return dir
+	}
+
+	// owner lock held by this process
+	running := makeDir(tempDirPrefix + "running")
+	ownerLock, err := createOwnerLock(running)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ownerLock.Close()
+
+	// owner lock not held, and the pid does not exist
+	orphaned := makeDir(tempDirPrefix + "orphaned")
+	err = os.WriteFile(filepath.Join(orphaned, ownerLockFileName), []byte("0\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// no owner lock: may be initializing
+	initializing := makeDir(tempDirPrefix + "initializing")
+	abandoned := makeDir(tempDirPrefix + "abandoned")
+	old := time.Now().Add(-2 * reapMinAge)
+	err = os.Chtimes(abandoned, old, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// wrong prefix: e.g. the shared instance
+	other := makeDir(sharedDirPrefix + "0")
+	err = os.Chtimes(other, old, old)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reaped, err := reapIn([]string{parent})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reaped) != 2 || reaped[0] != abandoned || reaped[1] != orphaned {
+		t.Errorf("expected to reap %s and %s; reaped=%#v", abandoned, orphaned, reaped)
+	}
+	for _, dir := range []string{running, initializing, other} {
+		_, err = os.Stat(dir)
+		if err != nil {
+			t.Errorf("dir=%s must not be deleted: %s", dir, err.Error())
+		}
+	}
+	for _, dir := range reaped {
+		_, err = os.Stat(dir)
+		if !os.IsNotExist(err) {
+			t.Errorf("dir=%s must be deleted; err=%v", dir, err)
+		}
+	}
+}
+
+func TestReapKilledOwner(t *testing.T) {
+	// not t.TempDir(): when running as root, the unprivileged user must be able to access the
+	// parent directories (see Options.UnprivilegedUser)
+	parent, err := os.MkdirTemp("", "reap_test_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(parent)
+	err = os.Chmod(parent, 0711)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(parent, tempDirPrefix+"killed")
+	instance, err := NewInstanceWithOptions(context.Background(), Options{DirPath: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instance.Close()
+
+	// simulate an owner that exited: nothing holds the lock
+	err = os.WriteFile(filepath.Join(dir, ownerLockFileName), []byte("0\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reaped, err := reapIn([]string{parent})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reaped) != 1 || reaped[0] != dir {
+		t.Errorf("expected to reap %s; reaped=%#v", dir, reaped)
+	}
+	if postmasterIsRunning(dir) {
+		t.Error("postgres must be shut down")
+	}
+	// Close must not signal the process again
+	instance.proc.wait()
+	instance.proc = nil
+}
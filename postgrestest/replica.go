@@ -0,0 +1,177 @@
+package postgrestest
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// time between checks in WaitForReplication
+const replicationPollInterval = 10 * time.Millisecond
+
+// StartReplica creates a hot standby replica of this instance using pg_basebackup, and starts it
+// with streaming replication. The replica is a separate Instance in a new temporary directory, so
+// it has its own URL(). It only accepts read-only queries until Promote() is called. The caller
+// must call Close() on the replica: closing the primary does not close it.
+func (i *Instance) StartReplica(ctx context.Context) (*Instance, error) {
+	// only connect with Unix sockets: TCP would use the same port as the primary
+	options := i.options
+	options.ListenOnLocalhost = false
+	options.InsecureGlobalPort = 0
+	options.TLS = false
+	options.Extensions = nil
+	options.DirPath = ""
+
+	dir, err := os.MkdirTemp(tempDirParent(options), tempDirPrefix)
+	if err != nil {
+		return nil, err
+	}
+	err = i.cfg.runAs.chown(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	replica := &Instance{
+		cfg:      i.cfg,
+		dbDir:    dir,
+		username: i.username,
+		password: i.password,
+		log:      newServerLog(options.Logger),
+		options:  options,
+		primary:  i,
+	}
+
+	// --write-recovery-conf: creates standby.signal and sets primary_conninfo
+	// --checkpoint=fast: start the backup immediately instead of waiting for a checkpoint
+	// --wal-method=stream: stream the WAL needed to make the backup consistent
+	cmd := commandWithOutput(options.Logger, replica.log.writer("pg_basebackup"),
+		i.cfg.binPath("pg_basebackup"),
+		"--pgdata="+dir,
+		"--host="+i.dbDir,
+		"--port="+strconv.Itoa(i.port()),
+		"--username="+i.username,
+		"--write-recovery-conf",
+		"--checkpoint=fast",
+		"--wal-method=stream",
+	)
+	i.cfg.runAs.setCredential(cmd)
+	err = cmd.Run()
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, &StartupError{"pg_basebackup failed", err,
+			replica.log.lastLines(startupErrorLogLines)}
+	}
+
+	replica.ownerLock, err = createOwnerLock(dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	err = replica.startServer(ctx, nil)
+	if err != nil {
+		replica.ownerLock.Close()
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return replica, nil
+}
+
+// Promote turns a replica created by StartReplica into a primary that accepts writes. It waits
+// until the promotion is complete.
+func (i *Instance) Promote(ctx context.Context) error {
+	if i.primary == nil {
+		return fmt.Errorf("postgrestest: Promote must be called on a replica")
+	}
+	conn, err := pgx.Connect(ctx, i.URL())
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+	var promoted bool
+	err = conn.QueryRow(ctx, `SELECT pg_promote(wait => true)`).Scan(&promoted)
+	if err != nil {
+		return err
+	}
+	if !promoted {
+		return fmt.Errorf("postgrestest: pg_promote() did not complete")
+	}
+	return conn.Close(ctx)
+}
+
+// ReplicationLag returns the number of bytes of write-ahead log that were written by the primary
+// but not yet replayed by this replica.
+func (i *Instance) ReplicationLag(ctx context.Context) (int64, error) {
+	if i.primary == nil {
+		return 0, fmt.Errorf("postgrestest: ReplicationLag must be called on a replica")
+	}
+	primaryLSN, err := queryLSN(ctx, i.primary.URL(), `SELECT pg_current_wal_lsn()::text`)
+	if err != nil {
+		return 0, err
+	}
+	replayLSN, err := queryLSN(ctx, i.URL(), `SELECT pg_last_wal_replay_lsn()::text`)
+	if err != nil {
+		return 0, err
+	}
+	if replayLSN >= primaryLSN {
+		return 0, nil
+	}
+	return int64(primaryLSN - replayLSN), nil
+}
+
+// WaitForReplication waits until this replica has replayed all the write-ahead log written by
+// the primary when it was called, or until ctx is done.
+func (i *Instance) WaitForReplication(ctx context.Context) error {
+	for {
+		lag, err := i.ReplicationLag(ctx)
+		if err != nil {
+			return err
+		}
+		if lag == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(replicationPollInterval):
+		}
+	}
+}
+
+// queryLSN connects to pgURL, and runs query that returns a pg_lsn as text.
+func queryLSN(ctx context.Context, pgURL string, query string) (uint64, error) {
+	conn, err := pgx.Connect(ctx, pgURL)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close(ctx)
+	var lsn string
+	err = conn.QueryRow(ctx, query).Scan(&lsn)
+	if err != nil {
+		return 0, err
+	}
+	return parseLSN(lsn)
+}
+
+// parseLSN parses a Postgres log sequence number in the text format "16/B374D848". See:
+// https://www.postgresql.org/docs/current/datatype-pg-lsn.html
+func parseLSN(lsn string) (uint64, error) {
+	high, low, found := strings.Cut(lsn, "/")
+	if !found {
+		return 0, fmt.Errorf("postgrestest: invalid LSN=%#v", lsn)
+	}
+	highValue, err := strconv.ParseUint(high, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("postgrestest: invalid LSN=%#v: %w", lsn, err)
+	}
+	lowValue, err := strconv.ParseUint(low, 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("postgrestest: invalid LSN=%#v: %w", lsn, err)
+	}
+	return highValue<<32 | lowValue, nil
+}
@@ -0,0 +1,96 @@
+package postgrestest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func TestParseLSN(t *testing.T) {
+	for _, test := range []struct {
+		lsn      string
+		expected uint64
+	}{
+		{"0/0", 0},
+		{"0/16B3748", 0x16B3748},
+		{"16/B374D848", 0x16_B374D848},
+	} {
+		value, err := parseLSN(test.lsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value != test.expected {
+			t.Errorf("parseLSN(%#v)=%x; expected %x", test.lsn, value, test.expected)
+		}
+	}
+
+	for _, invalid := range []string{"", "16", "x/0", "0/100000000"} {
+		_, err := parseLSN(invalid)
+		if err == nil {
+			t.Errorf("parseLSN(%#v) must return an error", invalid)
+		}
+	}
+}
+
+func TestReplica(t *testing.T) {
+	primary, err := NewInstance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+
+	ctx := context.Background()
+	err = primary.execSQL(ctx, defaultDatabase,
+		`CREATE TABLE example (id INTEGER PRIMARY KEY)`,
+		`INSERT INTO example VALUES (1)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	replica, err := primary.StartReplica(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer replica.Close()
+	if replica.URL() == primary.URL() {
+		t.Errorf("replica must have a different URL: %s", replica.URL())
+	}
+
+	// writes on the primary must be replicated
+	err = primary.execSQL(ctx, defaultDatabase, `INSERT INTO example VALUES (2)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = replica.WaitForReplication(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := pgx.Connect(ctx, replica.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(ctx)
+	var count int
+	err = conn.QueryRow(ctx, `SELECT COUNT(*) FROM example`).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("expected count=2 on the replica; was %d", count)
+	}
+
+	// the replica is read-only until promoted
+	_, err = conn.Exec(ctx, `INSERT INTO example VALUES (3)`)
+	if err == nil {
+		t.Error("writes to the replica must fail")
+	}
+	err = replica.Promote(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Exec(ctx, `INSERT INTO example VALUES (3)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,109 @@
+package postgrestest
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// default for Options.UnprivilegedUser: created by the Debian and Ubuntu postgresql packages
+const defaultUnprivilegedUser = "postgres"
+
+// runAsUser is the user that runs initdb and postgres when the current process is root, since
+// Postgres refuses to run as root.
+type runAsUser struct {
+	username   string
+	credential *syscall.Credential
+}
+
+// lookupRunAsUser returns the user named username if the current process is root, or nil
+// otherwise. If username is empty, it uses defaultUnprivilegedUser.
+func lookupRunAsUser(username string) (*runAsUser, error) {
+	if os.Geteuid() != 0 {
+		return nil, nil
+	}
+	if username == "" {
+		username = defaultUnprivilegedUser
+	}
+	u, err := user.Lookup(username)
+	if err != nil {
+		return nil, fmt.Errorf("postgrestest: running as root requires an unprivileged user: %w", err)
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, err
+	}
+	if uid == 0 {
+		return nil, fmt.Errorf("postgrestest: UnprivilegedUser=%#v must not be root", username)
+	}
+	// do not inherit root's supplementary groups
+	groupIDs, err := u.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+	groups := make([]uint32, 0, len(groupIDs))
+	for _, groupID := range groupIDs {
+		group, err := strconv.ParseUint(groupID, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, uint32(group))
+	}
+	credential := &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), Groups: groups}
+	return &runAsUser{username, credential}, nil
+}
+
+// superuserName returns the name of the Postgres superuser created by initdb, which is the name
+// of the OS user that runs it.
+func (r *runAsUser) superuserName() (string, error) {
+	if r != nil {
+		return r.username, nil
+	}
+	currentUser, err := user.Current()
+	if err != nil {
+		return "", err
+	}
+	return currentUser.Username, nil
+}
+
+// setCredential configures cmd to run as this user. It does nothing if r is nil.
+func (r *runAsUser) setCredential(cmd *exec.Cmd) {
+	if r == nil {
+		return
+	}
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Credential = r.credential
+}
+
+// chown changes the owner of path to this user. It does nothing if r is nil.
+func (r *runAsUser) chown(path string) error {
+	if r == nil {
+		return nil
+	}
+	return os.Lchown(path, int(r.credential.Uid), int(r.credential.Gid))
+}
+
+// chownAll changes the owner of dir and everything in it to this user. It does nothing if r is
+// nil.
+func (r *runAsUser) chownAll(dir string) error {
+	if r == nil {
+		return nil
+	}
+	return filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return r.chown(path)
+	})
+}
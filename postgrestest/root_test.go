@@ -0,0 +1,66 @@
+package postgrestest
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestLookupRunAsUser(t *testing.T) {
+	if os.Geteuid() != 0 {
+		runAs, err := lookupRunAsUser("nobody")
+		if runAs != nil || err != nil {
+			t.Errorf("lookupRunAsUser()=%#v, %v; expected nil when not root", runAs, err)
+		}
+		t.Skip("the rest of this test must run as root")
+	}
+
+	for _, invalid := range []string{"root", "does_not_exist"} {
+		_, err := lookupRunAsUser(invalid)
+		if err == nil {
+			t.Errorf("lookupRunAsUser(%#v) must return an error", invalid)
+		}
+	}
+
+	runAs, err := lookupRunAsUser("nobody")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, err := runAs.superuserName()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "nobody" || runAs.credential.Uid == 0 {
+		t.Errorf("unexpected name=%#v credential=%#v", name, runAs.credential)
+	}
+	// must not inherit root's supplementary groups
+	if runAs.credential.NoSetGroups {
+		t.Errorf("credential must set supplementary groups: %#v", runAs.credential)
+	}
+	for _, group := range runAs.credential.Groups {
+		if group == 0 {
+			t.Errorf("credential must not include the root group: %#v", runAs.credential)
+		}
+	}
+
+	dir := t.TempDir()
+	err = os.WriteFile(filepath.Join(dir, "file"), []byte("hello"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = runAs.chownAll(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{dir, filepath.Join(dir, "file")} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		uid := info.Sys().(*syscall.Stat_t).Uid
+		if uid != runAs.credential.Uid {
+			t.Errorf("path=%s expected uid=%d; was %d", path, runAs.credential.Uid, uid)
+		}
+	}
+}
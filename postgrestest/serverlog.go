@@ -0,0 +1,125 @@
+package postgrestest
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/exp/slog"
+)
+
+// the number of lines of output kept by each Instance
+const serverLogMaxLines = 1000
+
+// Matches the default log_line_prefix '%m [%p] ' followed by the severity:
+// "2020-12-12 13:56:45.520 EST [4446] LOG:  database system is ready to accept connections"
+// https://www.postgresql.org/docs/current/runtime-config-logging.html
+var serverLogLinePattern = regexp.MustCompile(`^\S+ \S+ \S+ \[(\d+)\] ([A-Z0-9]+):  (.*)$`)
+
+// serverLog keeps the most recent lines of output from Postgres processes in a ring buffer, and
+// logs each line to a slog.Logger. It is safe to use from multiple goroutines.
+type serverLog struct {
+	logger *slog.Logger
+
+	mu    sync.Mutex
+	lines []string
+	// index of the oldest line once lines is full
+	next int
+}
+
+func newServerLog(logger *slog.Logger) *serverLog {
+	return &serverLog{logger: logger}
+}
+
+// writer returns an io.Writer for the output of process, which must not be shared by multiple
+// processes, since it buffers partial lines.
+func (s *serverLog) writer(process string) io.Writer {
+	return &serverLogWriter{s, process, nil}
+}
+
+// String returns the most recent lines of output.
+func (s *serverLog) String() string {
+	return s.lastLines(serverLogMaxLines)
+}
+
+// lastLines returns the last n lines of output. It returns the empty string if s is nil.
+func (s *serverLog) lastLines(n int) string {
+	if s == nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var out strings.Builder
+	for i := max(len(s.lines)-n, 0); i < len(s.lines); i++ {
+		out.WriteString(s.lines[(s.next+i)%len(s.lines)])
+		out.WriteByte('\n')
+	}
+	return out.String()
+}
+
+func (s *serverLog) addLine(process string, line string) {
+	s.mu.Lock()
+	if len(s.lines) < serverLogMaxLines {
+		s.lines = append(s.lines, line)
+	} else {
+		s.lines[s.next] = line
+		s.next = (s.next + 1) % len(s.lines)
+	}
+	s.mu.Unlock()
+
+	attrs := []slog.Attr{slog.String("process", process)}
+	level := slog.LevelInfo
+	matches := serverLogLinePattern.FindStringSubmatch(line)
+	if matches != nil {
+		pid, err := strconv.Atoi(matches[1])
+		if err == nil {
+			attrs = append(attrs, slog.Int("pid", pid))
+		}
+		attrs = append(attrs, slog.String("severity", matches[2]))
+		level = serverLogLevel(matches[2])
+		line = matches[3]
+	}
+	s.logger.LogAttrs(context.Background(), level, line, attrs...)
+}
+
+// serverLogLevel returns the slog level for a Postgres severity. See:
+// https://www.postgresql.org/docs/current/runtime-config-logging.html#RUNTIME-CONFIG-SEVERITY-LEVELS
+func serverLogLevel(severity string) slog.Level {
+	switch {
+	case severity == "ERROR" || severity == "FATAL" || severity == "PANIC":
+		return slog.LevelError
+	case severity == "WARNING":
+		return slog.LevelWarn
+	case strings.HasPrefix(severity, "DEBUG"):
+		return slog.LevelDebug
+	default:
+		return slog.LevelInfo
+	}
+}
+
+type serverLogWriter struct {
+	log     *serverLog
+	process string
+	partial []byte
+}
+
+// Write implements io.Writer by splitting p into lines. It never returns an error.
+func (w *serverLogWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	remaining := w.partial
+	for {
+		line, rest, found := bytes.Cut(remaining, []byte("\n"))
+		if !found {
+			break
+		}
+		w.log.addLine(w.process, string(line))
+		remaining = rest
+	}
+	// copy so the buffer does not keep growing
+	w.partial = append(w.partial[:0], remaining...)
+	return len(p), nil
+}
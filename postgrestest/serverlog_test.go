@@ -0,0 +1,62 @@
+package postgrestest
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"golang.org/x/exp/slog"
+)
+
+func TestServerLog(t *testing.T) {
+	buf := &bytes.Buffer{}
+	log := newServerLog(slog.New(slog.NewTextHandler(buf, nil)))
+	w := log.writer("postgres")
+
+	// partial lines must be buffered until the newline
+	fmt.Fprint(w, "2020-12-12 13:56:45.520 EST [4446] LOG:  database system is ")
+	if log.String() != "" {
+		t.Errorf("partial line must not be in the log: %#v", log.String())
+	}
+	fmt.Fprint(w, "ready\nsecond line\n")
+	expected := "2020-12-12 13:56:45.520 EST [4446] LOG:  database system is ready\nsecond line\n"
+	if log.String() != expected {
+		t.Errorf("log.String()=%#v; expected %#v", log.String(), expected)
+	}
+
+	// the first line must be parsed into structured fields
+	logged := buf.String()
+	for _, expectedPart := range []string{
+		`level=INFO msg="database system is ready" process=postgres pid=4446 severity=LOG`,
+		`level=INFO msg="second line" process=postgres`,
+	} {
+		if !strings.Contains(logged, expectedPart) {
+			t.Errorf("logged output must contain %#v; was %#v", expectedPart, logged)
+		}
+	}
+
+	fmt.Fprint(w, "2020-12-12 13:56:45.520 EST [4447] FATAL:  example\n")
+	if !strings.Contains(buf.String(), `level=ERROR msg=example`) {
+		t.Errorf("FATAL must be logged as ERROR: %#v", buf.String())
+	}
+}
+
+func TestServerLogRingBuffer(t *testing.T) {
+	log := newServerLog(slog.New(slog.NewTextHandler(&bytes.Buffer{}, nil)))
+	w := log.writer("initdb")
+	for i := 0; i < serverLogMaxLines+5; i++ {
+		fmt.Fprintf(w, "line %d\n", i)
+	}
+
+	lines := strings.Split(strings.TrimSuffix(log.String(), "\n"), "\n")
+	if len(lines) != serverLogMaxLines {
+		t.Fatalf("expected %d lines; found %d", serverLogMaxLines, len(lines))
+	}
+	if lines[0] != "line 5" {
+		t.Errorf("expected oldest line to be line 5; was %#v", lines[0])
+	}
+	if lines[len(lines)-1] != fmt.Sprintf("line %d", serverLogMaxLines+4) {
+		t.Errorf("unexpected last line %#v", lines[len(lines)-1])
+	}
+}
@@ -0,0 +1,346 @@
+package postgrestest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/evanj/hacks/nilslog"
+	"golang.org/x/sys/unix"
+)
+
+// The shared instance is in os.TempDir()/sharedDirPrefix+uid. This must not start with
+// tempDirPrefix, so Reap does not delete it.
+const sharedDirPrefix = "postgrestest-shared-"
+
+// held exclusively while starting, attaching to, or stopping the shared instance
+const sharedSetupLockFileName = "setup.lock"
+
+// every process using the shared instance holds a shared lock on this file
+const sharedUsersLockFileName = "users.lock"
+
+const sharedDataDirName = "data"
+const sharedLogFileName = "postgres.log"
+
+// written by Postgres in the data directory; the first line is the postmaster's pid
+const postmasterPIDFileName = "postmaster.pid"
+
+// maximum time to wait for a Postgres server started by another process to shut down
+const postmasterShutdownTimeout = 10 * time.Second
+
+// sharedAttachment is the state of one user of the shared instance.
+type sharedAttachment struct {
+	dir       string
+	usersLock *os.File
+}
+
+// NewSharedInstance returns an Instance that is shared by all processes run by this user that
+// call NewSharedInstance. The first caller starts Postgres in a well-known directory, and later
+// callers connect to it. The caller must call Close(), which shuts down Postgres only if no other
+// process is still using it. Since all users share the same databases, most callers should use
+// NewShared() which creates a new database for each test.
+func NewSharedInstance() (*Instance, error) {
+	currentUser, err := user.Current()
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(os.TempDir(), sharedDirPrefix+currentUser.Uid)
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	setupLock, err := openLocked(filepath.Join(dir, sharedSetupLockFileName), unix.LOCK_EX)
+	if err != nil {
+		return nil, err
+	}
+	defer setupLock.Close()
+
+	// closing the file releases the lock if we fail below, or if this process exits
+	usersLock, err := openLocked(filepath.Join(dir, sharedUsersLockFileName), unix.LOCK_SH)
+	if err != nil {
+		return nil, err
+	}
+	shared := &sharedAttachment{dir, usersLock}
+
+	dataDir := filepath.Join(dir, sharedDataDirName)
+	cfg, err := readPGConfig(nilslog.New())
+	if err != nil {
+		usersLock.Close()
+		return nil, err
+	}
+	cfg.runAs, err = lookupRunAsUser("")
+	if err != nil {
+		usersLock.Close()
+		return nil, err
+	}
+	superuser, err := cfg.runAs.superuserName()
+	if err != nil {
+		usersLock.Close()
+		return nil, err
+	}
+	instance := &Instance{
+		cfg:      cfg,
+		dbDir:    dataDir,
+		username: superuser,
+		shared:   shared,
+	}
+	if postmasterIsRunning(dataDir) {
+		attached, err := waitForShared(instance.socketPath(), instance.username, dataDir)
+		if err != nil {
+			// never delete the directory of a running server
+			usersLock.Close()
+			return nil, err
+		}
+		if attached {
+			return instance, nil
+		}
+	}
+
+	// not running: delete anything left behind by a previous instance and start a new one
+	err = os.RemoveAll(dataDir)
+	if err != nil {
+		usersLock.Close()
+		return nil, err
+	}
+	err = os.Mkdir(dataDir, 0700)
+	if err != nil {
+		usersLock.Close()
+		return nil, err
+	}
+	// when running as root, postgres must be able to access dataDir
+	err = cfg.runAs.chown(dir)
+	if err != nil {
+		usersLock.Close()
+		return nil, err
+	}
+	logFile, err := os.OpenFile(filepath.Join(dir, sharedLogFileName),
+		os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		usersLock.Close()
+		return nil, err
+	}
+	defer logFile.Close()
+	started, err := startInstance(
+		context.Background(), dataDir, Options{Logger: nilslog.New()}, logFile, false)
+	if err != nil {
+		usersLock.Close()
+		return nil, fmt.Errorf("postgrestest: failed starting shared instance (see %s): %w",
+			logFile.Name(), err)
+	}
+	started.shared = shared
+	return started, nil
+}
+
+// waitForShared waits until the Postgres server running in dataDir accepts connections from user.
+// It returns false if the server exits, so the caller must start a new one. It returns an error if
+// the server is still running but not accepting connections after defaultStartupTimeout.
+func waitForShared(unixSocketPath string, user string, dataDir string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultStartupTimeout)
+	defer cancel()
+	for {
+		ready, err := checkReady(ctx, unixSocketPath, user)
+		if err == nil && ready {
+			return true, nil
+		}
+		if !postmasterIsRunning(dataDir) {
+			return false, nil
+		}
+		// starting, in crash recovery, or too many connections (53300): wait and try again
+		if err == nil {
+			err = errors.New("postgres is not ready")
+		}
+
+		select {
+		case <-ctx.Done():
+			return false, fmt.Errorf(
+				"postgrestest: shared instance in %s is running but not accepting connections: %w",
+				dataDir, err)
+		case <-time.After(readyPollInterval):
+		}
+	}
+}
+
+// release stops using the shared instance. If this was the last user, it shuts down Postgres and
+// deletes dataDir. If proc is not nil, this process started Postgres.
+func (s *sharedAttachment) release(dataDir string, proc *serverProcess) error {
+	setupLock, err := openLocked(filepath.Join(s.dir, sharedSetupLockFileName), unix.LOCK_EX)
+	if err != nil {
+		s.usersLock.Close()
+		return err
+	}
+	defer setupLock.Close()
+	defer s.usersLock.Close()
+
+	// converts our shared lock to exclusive: only succeeds if there are no other users
+	err = unix.Flock(int(s.usersLock.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+	if errors.Is(err, unix.EWOULDBLOCK) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	err = shutdownPostmaster(dataDir)
+	if err != nil {
+		return err
+	}
+	if proc != nil {
+		// ignore the exit status: it was killed
+		proc.wait()
+	}
+	return os.RemoveAll(dataDir)
+}
+
+// openLocked opens or creates path and locks it with flock(how).
+func openLocked(path string, how int) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = unix.Flock(int(f.Fd()), how)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// shutdownPostmaster shuts down the Postgres server using dataDir, if it is running, and waits for
+// it to exit. It works for servers started by other processes. If postmaster.pid names a process
+// that is not a postmaster using dataDir, the file is stale, and it does nothing.
+func shutdownPostmaster(dataDir string) error {
+	pid, running := runningPostmasterPID(dataDir)
+	if !running {
+		return nil
+	}
+	// SIGQUIT = immediate shutdown; see Close()
+	err := syscall.Kill(pid, syscall.SIGQUIT)
+	if err != nil && err != syscall.ESRCH {
+		return err
+	}
+	// Postgres deletes postmaster.pid when it exits. The process may still exist as a zombie if
+	// it was started by another process that is still running.
+	deadline := time.Now().Add(postmasterShutdownTimeout)
+	for postmasterIsRunning(dataDir) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("postgrestest: postgres pid=%d did not shut down", pid)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+// readPostmasterPID returns the pid of the Postgres server using dataDir.
+func readPostmasterPID(dataDir string) (int, error) {
+	data, err := os.ReadFile(filepath.Join(dataDir, postmasterPIDFileName))
+	if err != nil {
+		return 0, err
+	}
+	firstLine, _, _ := bytes.Cut(data, []byte("\n"))
+	return strconv.Atoi(string(bytes.TrimSpace(firstLine)))
+}
+
+// postmasterIsRunning returns true if a Postgres server is running in dataDir.
+func postmasterIsRunning(dataDir string) bool {
+	_, running := runningPostmasterPID(dataDir)
+	return running
+}
+
+// runningPostmasterPID returns the pid in dataDir's postmaster.pid file, and true if it is a
+// running process that uses dataDir. If Postgres exited without deleting the file (e.g. after a
+// reboot), the pid may belong to an unrelated process.
+func runningPostmasterPID(dataDir string) (int, bool) {
+	pid, err := readPostmasterPID(dataDir)
+	if err != nil || pid <= 0 {
+		return 0, false
+	}
+	err = syscall.Kill(pid, 0)
+	if err != nil && err != syscall.EPERM {
+		return 0, false
+	}
+	return pid, processInDir(pid, dataDir)
+}
+
+// processInDir returns true if the working directory of pid is dir. The postmaster changes to its
+// data directory when it starts. If /proc is not available (e.g. on Mac OS X), it cannot check,
+// and returns true.
+func processInDir(pid int, dir string) bool {
+	_, err := os.Stat("/proc/self/cwd")
+	if err != nil {
+		return true
+	}
+	// fails if the process exited, is a zombie, or is owned by another user
+	cwd, err := os.Readlink(filepath.Join("/proc", strconv.Itoa(pid), "cwd"))
+	if err != nil {
+		return false
+	}
+	resolvedDir, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return false
+	}
+	return cwd == resolvedDir
+}
+
+// the shared instance used by NewShared in this process
+var processShared struct {
+	mu       sync.Mutex
+	instance *Instance
+}
+
+// NewShared returns a connection string URL for a new empty database on the shared Postgres
+// instance (see NewSharedInstance), and drops the database after the test completes. This is much
+// faster than New() when many test binaries use Postgres, such as with go test ./... . NewShared
+// will call t.Fatal if an error happens.
+//
+// The test binary should call RunShared from TestMain so the shared instance is shut down when
+// the last test binary exits. Otherwise, it keeps running and will be used by the next caller.
+func NewShared(t testing.TB) string {
+	processShared.mu.Lock()
+	if processShared.instance == nil {
+		instance, err := NewSharedInstance()
+		if err != nil {
+			processShared.mu.Unlock()
+			t.Fatalf("failed starting shared postgres: %s", err.Error())
+			return "invalid_connection_string"
+		}
+		processShared.instance = instance
+	}
+	instance := processShared.instance
+	processShared.mu.Unlock()
+
+	return instance.newTestDatabase(t, "")
+}
+
+// RunShared calls m.Run(), then closes the shared instance used by NewShared, if it was used. It
+// returns the exit code to pass to os.Exit. Call it from TestMain:
+//
+//	func TestMain(m *testing.M) {
+//		os.Exit(postgrestest.RunShared(m))
+//	}
+func RunShared(m *testing.M) int {
+	code := m.Run()
+
+	processShared.mu.Lock()
+	defer processShared.mu.Unlock()
+	if processShared.instance != nil {
+		err := processShared.instance.Close()
+		processShared.instance = nil
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "postgrestest: error closing shared instance: %s\n", err.Error())
+			if code == 0 {
+				code = 1
+			}
+		}
+	}
+	return code
+}
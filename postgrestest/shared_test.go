@@ -0,0 +1,119 @@
+package postgrestest
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func TestMain(m *testing.M) {
+	os.Exit(RunShared(m))
+}
+
+func TestNewSharedInstance(t *testing.T) {
+	instance1, err := NewSharedInstance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instance1.Close()
+	instance2, err := NewSharedInstance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instance2.Close()
+
+	if instance1.URL() != instance2.URL() {
+		t.Errorf("shared instances must have the same URL: %s != %s", instance1.URL(), instance2.URL())
+	}
+
+	// closing one user must not shut down the instance
+	err = instance1.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, instance2.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = conn.Close(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// closing the last user shuts it down, unless NewShared or another test binary is using it
+	err = instance2.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewShared(t *testing.T) {
+	url1 := NewShared(t)
+	url2 := NewShared(t)
+	if url1 == url2 {
+		t.Errorf("each call must return a new database: %s", url1)
+	}
+
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, url1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(ctx)
+	_, err = conn.Exec(ctx, `CREATE TABLE example (id INTEGER)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = conn.Close(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the second database must not have the table
+	conn, err = pgx.Connect(ctx, url2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(ctx)
+	var count int
+	err = conn.QueryRow(ctx,
+		`SELECT COUNT(*) FROM information_schema.tables WHERE table_name = 'example'`).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("expected table to not exist in second database; count=%d", count)
+	}
+}
+
+func TestShutdownPostmasterStalePID(t *testing.T) {
+	// a postmaster.pid left behind after a reboot can name an unrelated process
+	dataDir := t.TempDir()
+	pidFile := []byte(strconv.Itoa(os.Getpid()) + "\n" + dataDir + "\n")
+	err := os.WriteFile(filepath.Join(dataDir, postmasterPIDFileName), pidFile, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if postmasterIsRunning(dataDir) {
+		t.Error("postmasterIsRunning must be false for a process using another directory")
+	}
+	// must not signal this process
+	err = shutdownPostmaster(dataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// this process's working directory
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !processInDir(os.Getpid(), cwd) {
+		t.Errorf("processInDir(%d, %s) must be true", os.Getpid(), cwd)
+	}
+}
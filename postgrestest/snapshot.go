@@ -0,0 +1,164 @@
+package postgrestest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// prefix for the template databases created by Snapshot
+const snapshotDatabasePrefix = "snapshot_"
+
+// prefix for the copy of a snapshot created by Restore, before it is renamed
+const restoringDatabasePrefix = "restoring_"
+
+// database that Snapshot and Restore connect to. They cannot connect to the default database,
+// which they copy or drop, or to template1, since CREATE DATABASE fails if its template has
+// connections.
+const maintenanceDatabase = "postgrestest_maintenance"
+
+// Postgres error code when creating a database that already exists. See:
+// https://www.postgresql.org/docs/current/errcodes-appendix.html
+const pgCodeDuplicateDatabase = "42P04"
+
+// Snapshot saves a copy of the database used by URL(), which can be restored later with Restore.
+// This allows a test to set up some state once, then run multiple scenarios starting from it. It
+// terminates all connections to the database, since Postgres cannot copy a database that is in
+// use. The name must only contain lower case letters, digits and underscores, must not start with
+// a digit, and must not be used by an existing snapshot. See:
+// https://www.postgresql.org/docs/current/manage-ag-templatedbs.html
+func (i *Instance) Snapshot(ctx context.Context, name string) error {
+	if i.shared != nil {
+		return errors.New("postgrestest: Snapshot is not supported on a shared instance")
+	}
+	if !simpleIdentifier.MatchString(name) {
+		return fmt.Errorf("postgrestest: invalid snapshot name=%#v", name)
+	}
+	quotedDefault := doubleQuoteIdentifier(defaultDatabase)
+	quotedSnapshot := doubleQuoteIdentifier(snapshotDatabasePrefix + name)
+
+	conn, err := i.connectMaintenance(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+
+	// prevent clients from reconnecting until the copy is done
+	_, err = conn.Exec(ctx, "ALTER DATABASE "+quotedDefault+" WITH ALLOW_CONNECTIONS false")
+	if err != nil {
+		return err
+	}
+	_, err = conn.Exec(ctx,
+		`SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = $1`, defaultDatabase)
+	if err == nil {
+		// CREATE DATABASE waits a few seconds for the terminated connections to exit
+		_, err = conn.Exec(ctx, "CREATE DATABASE "+quotedSnapshot+" TEMPLATE "+quotedDefault)
+	}
+	// always allow connections again, even if the copy failed
+	_, allowErr := conn.Exec(ctx, "ALTER DATABASE "+quotedDefault+" WITH ALLOW_CONNECTIONS true")
+	if err != nil {
+		return err
+	}
+	if allowErr != nil {
+		return allowErr
+	}
+
+	// ALLOW_CONNECTIONS false ensures nothing modifies the snapshot
+	_, err = conn.Exec(ctx,
+		"ALTER DATABASE "+quotedSnapshot+" WITH IS_TEMPLATE true ALLOW_CONNECTIONS false")
+	if err != nil {
+		return err
+	}
+	return conn.Close(ctx)
+}
+
+// Restore replaces the database used by URL() with a copy of the snapshot created by Snapshot.
+// It terminates all connections to the database, so clients must reconnect. The snapshot is not
+// changed, so it can be restored multiple times.
+func (i *Instance) Restore(ctx context.Context, name string) error {
+	if i.shared != nil {
+		return errors.New("postgrestest: Restore is not supported on a shared instance")
+	}
+	if !simpleIdentifier.MatchString(name) {
+		return fmt.Errorf("postgrestest: invalid snapshot name=%#v", name)
+	}
+	conn, err := i.connectMaintenance(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+
+	// check the snapshot exists before dropping the database
+	var exists bool
+	err = conn.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM pg_database WHERE datname = $1)`,
+		snapshotDatabasePrefix+name).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("postgrestest: snapshot name=%#v does not exist", name)
+	}
+
+	// copy the snapshot before dropping the database, so it still exists if the copy fails
+	suffix, err := randomHex(8)
+	if err != nil {
+		return err
+	}
+	quotedRestoring := doubleQuoteIdentifier(restoringDatabasePrefix + suffix)
+	_, err = conn.Exec(ctx, "CREATE DATABASE "+quotedRestoring+" TEMPLATE "+
+		doubleQuoteIdentifier(snapshotDatabasePrefix+name))
+	if err != nil {
+		return err
+	}
+
+	// FORCE terminates existing connections and waits for them to exit
+	quotedDefault := doubleQuoteIdentifier(defaultDatabase)
+	_, err = conn.Exec(ctx, "DROP DATABASE "+quotedDefault+" WITH (FORCE)")
+	if err != nil {
+		_, dropErr := conn.Exec(ctx, "DROP DATABASE "+quotedRestoring)
+		if dropErr != nil {
+			return fmt.Errorf("%w; dropping the copy of the snapshot also failed: %w", err, dropErr)
+		}
+		return err
+	}
+	_, err = conn.Exec(ctx, "ALTER DATABASE "+quotedRestoring+" RENAME TO "+quotedDefault)
+	if err != nil {
+		return err
+	}
+	return conn.Close(ctx)
+}
+
+// connectMaintenance connects to maintenanceDatabase, creating it if it does not exist.
+func (i *Instance) connectMaintenance(ctx context.Context) (*pgx.Conn, error) {
+	conn, err := pgx.Connect(ctx, i.URLForDatabase(defaultDatabase))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close(ctx)
+	var exists bool
+	err = conn.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM pg_database WHERE datname = $1)`,
+		maintenanceDatabase).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		_, err = conn.Exec(ctx, "CREATE DATABASE "+doubleQuoteIdentifier(maintenanceDatabase))
+		var pgErr *pgconn.PgError
+		if errors.As(err, &pgErr) && pgErr.Code == pgCodeDuplicateDatabase {
+			// created concurrently
+			err = nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	// close the connection first: Snapshot cannot copy the default database while it is in use
+	err = conn.Close(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.Connect(ctx, i.URLForDatabase(maintenanceDatabase))
+}
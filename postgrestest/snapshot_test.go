@@ -0,0 +1,117 @@
+package postgrestest
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func TestSnapshot(t *testing.T) {
+	instance, err := NewInstance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instance.Close()
+
+	ctx := context.Background()
+	err = instance.execSQL(ctx, defaultDatabase,
+		`CREATE TABLE example (id INTEGER PRIMARY KEY)`,
+		`INSERT INTO example VALUES (1)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// open connections must be terminated
+	conn, err := pgx.Connect(ctx, instance.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(ctx)
+	err = instance.Snapshot(ctx, "setup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = instance.Snapshot(ctx, "setup")
+	if err == nil {
+		t.Error("Snapshot with a duplicate name must return an error")
+	}
+	err = instance.Restore(ctx, "does_not_exist")
+	if err == nil {
+		t.Error("Restore of a snapshot that does not exist must return an error")
+	}
+
+	// each scenario starts from the snapshot
+	for i := 0; i < 2; i++ {
+		conn, err := pgx.Connect(ctx, instance.URL())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close(ctx)
+		_, err = conn.Exec(ctx, `INSERT INTO example VALUES (2)`)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = instance.Restore(ctx, "setup")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = conn.Ping(ctx)
+		if err == nil {
+			t.Error("Restore must terminate open connections")
+		}
+	}
+
+	conn, err = pgx.Connect(ctx, instance.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(ctx)
+	var count int
+	err = conn.QueryRow(ctx, `SELECT COUNT(*) FROM example`).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("expected count=1 after Restore; was %d", count)
+	}
+}
+
+func TestSnapshotTemplate1NotInUse(t *testing.T) {
+	instance, err := NewInstance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instance.Close()
+
+	// Snapshot and Restore must not connect to template1, which createDatabase copies
+	ctx := context.Background()
+	err = instance.Snapshot(ctx, "setup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := instance.connectMaintenance(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(ctx)
+	_, err = instance.createDatabase(ctx, "")
+	if err != nil {
+		t.Errorf("createDatabase must work while the maintenance database is in use: %s", err)
+	}
+
+	err = instance.Restore(ctx, "setup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	err = conn.QueryRow(ctx,
+		`SELECT COUNT(*) FROM pg_database WHERE datname LIKE $1`, restoringDatabasePrefix+"%").Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("Restore must rename its copy; found %d restoring databases", count)
+	}
+}
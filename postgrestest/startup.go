@@ -0,0 +1,106 @@
+package postgrestest
+
+import (
+	"context"
+	"os/exec"
+	"time"
+)
+
+// the number of lines of output included in StartupError
+const startupErrorLogLines = 20
+
+// time between attempts to connect while waiting for Postgres to start
+const readyPollInterval = 10 * time.Millisecond
+
+// StartupError is returned when Postgres fails to start.
+type StartupError struct {
+	// What failed
+	Reason string
+	// The error that caused the failure
+	Err error
+	// The last lines of output from initdb and postgres
+	LogTail string
+}
+
+func (e *StartupError) Error() string {
+	msg := "postgrestest: " + e.Reason
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	if e.LogTail != "" {
+		msg += "\npostgres output:\n" + e.LogTail
+	}
+	return msg
+}
+
+func (e *StartupError) Unwrap() error {
+	return e.Err
+}
+
+// serverProcess is a running postgres process. A goroutine waits for it to exit, so callers can
+// detect when it exits without blocking.
+type serverProcess struct {
+	cmd  *exec.Cmd
+	done chan struct{}
+	// result of cmd.Wait(); only valid after done is closed
+	err error
+	// output of the process; nil if it is written to a file
+	log *serverLog
+}
+
+// startServerProcess starts cmd and a goroutine that waits for it to exit.
+func startServerProcess(cmd *exec.Cmd, log *serverLog) (*serverProcess, error) {
+	err := cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	proc := &serverProcess{cmd, make(chan struct{}), nil, log}
+	go func() {
+		proc.err = cmd.Wait()
+		close(proc.done)
+	}()
+	return proc, nil
+}
+
+// exited returns true if the process has exited.
+func (p *serverProcess) exited() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait waits for the process to exit and returns the result of cmd.Wait().
+func (p *serverProcess) wait() error {
+	<-p.done
+	return p.err
+}
+
+// waitUntilReady polls unixSocketPath until Postgres accepts connections from user. It returns a
+// *StartupError if ctx is done, if proc exits, or if Postgres rejects the connection.
+func waitUntilReady(
+	ctx context.Context, unixSocketPath string, user string, proc *serverProcess,
+) error {
+	for {
+		ready, err := checkReady(ctx, unixSocketPath, user)
+		if err != nil && ctx.Err() != nil {
+			return &StartupError{"postgres did not accept connections", ctx.Err(), proc.log.lastLines(startupErrorLogLines)}
+		}
+		if err != nil {
+			return &StartupError{"failed connecting to " + unixSocketPath, err, proc.log.lastLines(startupErrorLogLines)}
+		}
+		if ready {
+			return nil
+		}
+
+		select {
+		case <-proc.done:
+			return &StartupError{"postgres exited while starting", proc.err, proc.log.lastLines(startupErrorLogLines)}
+		case <-ctx.Done():
+			return &StartupError{"postgres did not accept connections", ctx.Err(), proc.log.lastLines(startupErrorLogLines)}
+		case <-time.After(readyPollInterval):
+		}
+	}
+}
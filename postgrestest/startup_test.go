@@ -0,0 +1,100 @@
+package postgrestest
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/evanj/hacks/nilslog"
+	"github.com/evanj/hacks/pgwire"
+)
+
+func TestWaitUntilReadyProcessExited(t *testing.T) {
+	log := newServerLog(nilslog.New())
+	cmd := exec.Command("sh", "-c", "echo 'FATAL: example failure' && exit 1")
+	cmd.Stdout = log.writer("postgres")
+	proc, err := startServerProcess(cmd, log)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = waitUntilReady(context.Background(), filepath.Join(t.TempDir(), "socket"), "postgres", proc)
+	var startupErr *StartupError
+	if !errors.As(err, &startupErr) {
+		t.Fatalf("expected StartupError; err=%#v", err)
+	}
+	if !strings.Contains(startupErr.Reason, "exited") {
+		t.Errorf("unexpected reason: %s", startupErr.Reason)
+	}
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		t.Errorf("expected error to wrap the exit status; err=%#v", startupErr.Err)
+	}
+	if !strings.Contains(err.Error(), "FATAL: example failure") {
+		t.Errorf("error must include the process output: %s", err.Error())
+	}
+}
+
+func TestWaitUntilReadyTimeout(t *testing.T) {
+	cmd := exec.Command("sleep", "60")
+	proc, err := startServerProcess(cmd, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proc.wait()
+	defer cmd.Process.Kill()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = waitUntilReady(ctx, filepath.Join(t.TempDir(), "socket"), "postgres", proc)
+	var startupErr *StartupError
+	if !errors.As(err, &startupErr) {
+		t.Fatalf("expected StartupError; err=%#v", err)
+	}
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected error to wrap context.Canceled; err=%#v", startupErr.Err)
+	}
+}
+
+func TestNewInstanceWithOptionsStartupError(t *testing.T) {
+	instance, err := NewInstanceWithOptions(context.Background(), Options{
+		ServerConfig: map[string]string{"invalid_setting_name": "1"},
+	})
+	if instance != nil {
+		t.Error(instance)
+	}
+	var startupErr *StartupError
+	if !errors.As(err, &startupErr) {
+		t.Fatalf("expected StartupError; err=%#v", err)
+	}
+	if !strings.Contains(startupErr.LogTail, "invalid_setting_name") {
+		t.Errorf("expected log tail to include the error: %s", startupErr.LogTail)
+	}
+}
+
+func TestCheckReadyDiagnostic(t *testing.T) {
+	instance, err := NewInstance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instance.Close()
+
+	ctx := context.Background()
+	ready, err := checkReady(ctx, instance.socketPath(), instance.username)
+	if !ready || err != nil {
+		t.Errorf("checkReady()=%t, %v; expected ready", ready, err)
+	}
+
+	// any error other than "starting up" is returned with the details from Postgres
+	ready, err = checkReady(ctx, instance.socketPath(), "does_not_exist")
+	var pgErr *pgwire.Error
+	if ready || !errors.As(err, &pgErr) {
+		t.Fatalf("checkReady()=%t, %#v; expected a *pgwire.Error", ready, err)
+	}
+	if pgErr.Code != "28000" || !strings.Contains(pgErr.Message, "does_not_exist") {
+		t.Errorf("unexpected error: %s", pgErr.Error())
+	}
+}
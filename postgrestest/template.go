@@ -0,0 +1,124 @@
+package postgrestest
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+// Template is a database that is initialized once, then copied to create new databases. Copying
+// a template is much faster than running initdb and starting a new Postgres process, so tests can
+// share one Instance and still get an isolated database each. A common pattern is to create the
+// Instance and Template in TestMain, then call Template.New(t) in each test. See:
+// https://www.postgresql.org/docs/current/manage-ag-templatedbs.html
+type Template struct {
+	instance *Instance
+	name     string
+}
+
+// NewTemplate creates a new database, calls setup with a connection URL for it, then marks it as
+// a template. Setup should create the tables and data that all tests need (e.g. by running
+// migrations). Any connections to the template that are still open when setup returns will be
+// terminated, since Postgres cannot copy a database that is in use.
+func (i *Instance) NewTemplate(
+	ctx context.Context, setup func(ctx context.Context, url string) error,
+) (*Template, error) {
+	suffix, err := randomHex(8)
+	if err != nil {
+		return nil, err
+	}
+	name := "template_" + suffix
+	quotedName := doubleQuoteIdentifier(name)
+	err = i.execSQL(ctx, defaultDatabase, "CREATE DATABASE "+quotedName)
+	if err != nil {
+		return nil, err
+	}
+
+	err = setup(ctx, i.URLForDatabase(name))
+	if err != nil {
+		err = fmt.Errorf("postgrestest: template setup failed: %w", err)
+		return nil, i.dropFailedTemplate(ctx, name, err)
+	}
+
+	// ALLOW_CONNECTIONS false ensures nothing modifies the template after it is set up.
+	// CREATE DATABASE waits a few seconds for the terminated connections to exit.
+	err = i.execSQL(ctx, defaultDatabase,
+		"ALTER DATABASE "+quotedName+" WITH IS_TEMPLATE true ALLOW_CONNECTIONS false",
+		fmt.Sprintf("SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE datname = '%s'", name),
+	)
+	if err != nil {
+		return nil, i.dropFailedTemplate(ctx, name, err)
+	}
+	return &Template{i, name}, nil
+}
+
+// dropFailedTemplate drops the template database name after setting it up failed with err, so it
+// does not remain in the instance. It returns err, and the error from dropping if any.
+func (i *Instance) dropFailedTemplate(ctx context.Context, name string, err error) error {
+	// IS_TEMPLATE must be false to drop it; FORCE terminates connections setup did not close
+	quotedName := doubleQuoteIdentifier(name)
+	dropErr := i.execSQL(ctx, defaultDatabase,
+		"ALTER DATABASE "+quotedName+" WITH IS_TEMPLATE false",
+		"DROP DATABASE "+quotedName+" WITH (FORCE)",
+	)
+	if dropErr != nil {
+		return fmt.Errorf("%w; dropping template database also failed: %w", err, dropErr)
+	}
+	return err
+}
+
+// NewDatabase creates a new database that is a copy of the template, and returns a connection
+// URL for it. The database is deleted when the Instance is closed.
+func (t *Template) NewDatabase(ctx context.Context) (string, error) {
+	name, err := t.instance.createDatabase(ctx, t.name)
+	if err != nil {
+		return "", err
+	}
+	return t.instance.URLForDatabase(name), nil
+}
+
+// New creates a new database that is a copy of the template, and returns a connection URL for it.
+// The database is dropped after the test completes. New will call t.Fatal if an error happens.
+func (t *Template) New(tb testing.TB) string {
+	return t.instance.newTestDatabase(tb, t.name)
+}
+
+// createDatabase creates a new database with a random name and returns the name. If templateName
+// is not empty, the database is a copy of it. Otherwise, it is a copy of the default template1.
+func (i *Instance) createDatabase(ctx context.Context, templateName string) (string, error) {
+	suffix, err := randomHex(8)
+	if err != nil {
+		return "", err
+	}
+	name := "test_" + suffix
+	statement := "CREATE DATABASE " + doubleQuoteIdentifier(name)
+	if templateName != "" {
+		statement += " TEMPLATE " + doubleQuoteIdentifier(templateName)
+	}
+	err = i.execSQL(ctx, defaultDatabase, statement)
+	if err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// newTestDatabase calls createDatabase, and drops the database after the test completes. It
+// returns a connection URL for the database, or calls t.Fatal if an error happens.
+func (i *Instance) newTestDatabase(tb testing.TB, templateName string) string {
+	ctx := context.Background()
+	name, err := i.createDatabase(ctx, templateName)
+	if err != nil {
+		tb.Fatalf("failed creating database: %s", err.Error())
+		// Fatalf should terminate execution, but just in case, don't return "": it is a valid string!
+		return "invalid_connection_string"
+	}
+	tb.Cleanup(func() {
+		// FORCE terminates connections the test did not close
+		err := i.execSQL(ctx, defaultDatabase,
+			"DROP DATABASE "+doubleQuoteIdentifier(name)+" WITH (FORCE)")
+		if err != nil {
+			tb.Logf("warning: error dropping database %s: %s", name, err.Error())
+		}
+	})
+	return i.URLForDatabase(name)
+}
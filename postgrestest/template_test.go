@@ -0,0 +1,115 @@
+package postgrestest
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func TestTemplate(t *testing.T) {
+	instance, err := NewInstance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instance.Close()
+
+	ctx := context.Background()
+	setupCount := 0
+	template, err := instance.NewTemplate(ctx, func(ctx context.Context, url string) error {
+		setupCount++
+		conn, err := pgx.Connect(ctx, url)
+		if err != nil {
+			return err
+		}
+		// deliberately leave the connection open: NewTemplate must terminate it
+		_, err = conn.Exec(ctx, `CREATE TABLE example (id INTEGER PRIMARY KEY)`)
+		if err != nil {
+			return err
+		}
+		_, err = conn.Exec(ctx, `INSERT INTO example VALUES (1)`)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// each database is a separate copy of the template
+	url1 := template.New(t)
+	url2, err := template.NewDatabase(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if url1 == url2 || url1 == instance.URL() {
+		t.Errorf("databases must have different URLs: %s %s", url1, url2)
+	}
+
+	conn1, err := pgx.Connect(ctx, url1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn1.Close(ctx)
+	_, err = conn1.Exec(ctx, `INSERT INTO example VALUES (2)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn2, err := pgx.Connect(ctx, url2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn2.Close(ctx)
+	var count int
+	err = conn2.QueryRow(ctx, `SELECT COUNT(*) FROM example`).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("expected count=1 in second database; was %d", count)
+	}
+	if setupCount != 1 {
+		t.Errorf("setup must be called once; setupCount=%d", setupCount)
+	}
+}
+
+func TestTemplateSetupFailure(t *testing.T) {
+	instance, err := NewInstance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instance.Close()
+
+	ctx := context.Background()
+	exampleErr := errors.New("example error")
+	_, err = instance.NewTemplate(ctx, func(ctx context.Context, url string) error {
+		// leave a connection open: the database must still be dropped
+		conn, err := pgx.Connect(ctx, url)
+		if err != nil {
+			return err
+		}
+		_, err = conn.Exec(ctx, `CREATE TABLE example (id INTEGER PRIMARY KEY)`)
+		if err != nil {
+			return err
+		}
+		return exampleErr
+	})
+	if !errors.Is(err, exampleErr) {
+		t.Fatalf("expected setup error; got %v", err)
+	}
+
+	conn, err := pgx.Connect(ctx, instance.URL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(ctx)
+	var count int
+	err = conn.QueryRow(ctx,
+		`SELECT COUNT(*) FROM pg_database WHERE datname LIKE 'template\_%'`).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("expected the failed template database to be dropped; count=%d", count)
+	}
+}
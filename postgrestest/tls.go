@@ -0,0 +1,115 @@
+package postgrestest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	cryptorand "crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Postgres's defaults for ssl_cert_file and ssl_key_file, relative to the data directory
+const tlsCertFileName = "server.crt"
+const tlsKeyFileName = "server.key"
+
+// the CA certificate that signed the server certificate, for clients to verify the server
+const tlsCACertFileName = "postgrestest_ca.crt"
+
+// certificates are generated each time Postgres starts, so they do not need to be valid for long
+const tlsCertValidity = 7 * 24 * time.Hour
+
+// inserted at the start of pg_hba.conf when using Options.TLS, so TLS connections from any
+// address must use a password. The default rules trust localhost connections without a password.
+const tlsAuthConfig = "hostssl all all 0.0.0.0/0 scram-sha-256\nhostssl all all ::0/0 scram-sha-256\n"
+
+// writeTLSFiles generates a new CA certificate and a server certificate signed by it, valid for
+// localhost and ipAddresses, and writes them to dir. It returns the CA certificate in PEM format.
+func writeTLSFiles(dir string, ipAddresses []net.IP) ([]byte, error) {
+	now := time.Now()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "postgrestest CA"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(tlsCertValidity),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(
+		cryptorand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return nil, err
+	}
+
+	serverKey, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serverTemplate := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(tlsCertValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  append([]net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback}, ipAddresses...),
+	}
+	serverDER, err := x509.CreateCertificate(
+		cryptorand.Reader, serverTemplate, caCert, &serverKey.PublicKey, caKey)
+	if err != nil {
+		return nil, err
+	}
+	serverKeyDER, err := x509.MarshalPKCS8PrivateKey(serverKey)
+	if err != nil {
+		return nil, err
+	}
+
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{tlsCACertFileName, caPEM},
+		{tlsCertFileName, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: serverDER})},
+		// Postgres requires the key to only be readable by the owner
+		{tlsKeyFileName, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: serverKeyDER})},
+	}
+	for _, file := range files {
+		err = os.WriteFile(filepath.Join(dir, file.name), file.data, 0600)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return caPEM, nil
+}
+
+// globalUnicastAddresses returns the IP addresses of this machine that are not localhost.
+func globalUnicastAddresses() ([]net.IP, error) {
+	addresses, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, address := range addresses {
+		ipNet, ok := address.(*net.IPNet)
+		if ok && ipNet.IP.IsGlobalUnicast() {
+			ips = append(ips, ipNet.IP)
+		}
+	}
+	return ips, nil
+}
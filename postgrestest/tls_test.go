@@ -0,0 +1,88 @@
+package postgrestest
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func TestWriteTLSFiles(t *testing.T) {
+	dir := t.TempDir()
+	caPEM, err := writeTLSFiles(dir, []net.IP{net.IPv4(192, 0, 2, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		t.Fatal("failed to parse CA certificate")
+	}
+	serverCert, err := tls.LoadX509KeyPair(
+		filepath.Join(dir, tlsCertFileName), filepath.Join(dir, tlsKeyFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(serverCert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"localhost", "127.0.0.1", "::1", "192.0.2.1"} {
+		_, err = leaf.Verify(x509.VerifyOptions{DNSName: host, Roots: roots})
+		if err != nil {
+			t.Errorf("host=%s: %s", host, err)
+		}
+	}
+	_, err = leaf.Verify(x509.VerifyOptions{DNSName: "example.com", Roots: roots})
+	if err == nil {
+		t.Error("certificate must not be valid for example.com")
+	}
+
+	info, err := os.Stat(filepath.Join(dir, tlsKeyFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("key file must only be readable by the owner; mode=%s", info.Mode())
+	}
+}
+
+func TestNewInstanceWithTLS(t *testing.T) {
+	instance, err := NewInstanceWithOptions(context.Background(), Options{TLS: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instance.Close()
+
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, instance.TLSURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(ctx)
+	var usesSSL bool
+	err = conn.QueryRow(ctx, `SELECT ssl FROM pg_stat_ssl WHERE pid = pg_backend_pid()`).Scan(&usesSSL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !usesSSL {
+		t.Error("connection must use TLS")
+	}
+
+	// TLS connections without the password must fail
+	noPasswordURL := strings.Replace(instance.TLSURL(), ":"+instance.password+"@", "@", 1)
+	_, err = pgx.Connect(ctx, noPasswordURL)
+	if err == nil {
+		t.Error("connecting without a password must fail")
+	}
+
+	if len(instance.TLSCACertPEM()) == 0 {
+		t.Error("TLSCACertPEM must not be empty")
+	}
+}
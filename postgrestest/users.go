@@ -0,0 +1,217 @@
+package postgrestest
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const pgIdentConfigFileName = "pg_ident.conf"
+
+// the pg_ident.conf map that allows the current OS user to connect as users with
+// UserOptions.PeerAuth
+const peerAuthMapName = "postgrestest"
+
+// names that do not need to be quoted in SQL or in pg_hba.conf
+var simpleIdentifier = regexp.MustCompile(`^[a-z_][a-z0-9_]*$`)
+
+// time between checks in reloadConfig
+const reloadPollInterval = 10 * time.Millisecond
+
+// UserOptions configures a user created by Instance.CreateUser. By default, the user can log in
+// with a generated password, and has no other privileges. Use the superuser URL() to grant it
+// privileges on specific tables.
+type UserOptions struct {
+	// If true, the user can create databases (CREATEDB).
+	CreateDB bool
+
+	// If true, the user can create, alter and drop other roles (CREATEROLE).
+	CreateRole bool
+
+	// Roles to grant to the user, such as the predefined roles pg_read_all_data or
+	// pg_write_all_data. See:
+	// https://www.postgresql.org/docs/current/predefined-roles.html
+	MemberOf []string
+
+	// If true, the user does not have a password. Instead, the OS user running this process can
+	// connect as this user using a Unix socket, with peer authentication.
+	PeerAuth bool
+}
+
+// CreateUser creates a Postgres role named name that can log in, and changes pg_hba.conf so it
+// must authenticate with a password, or with peer authentication if options.PeerAuth is set.
+// Use URLForUser() to connect. The name must only contain lower case letters, digits and
+// underscores, and must not start with a digit.
+func (i *Instance) CreateUser(ctx context.Context, name string, options UserOptions) error {
+	if !simpleIdentifier.MatchString(name) {
+		return fmt.Errorf("postgrestest: invalid user name=%#v", name)
+	}
+	i.usersMu.Lock()
+	defer i.usersMu.Unlock()
+	if _, exists := i.users[name]; exists {
+		return fmt.Errorf("postgrestest: user name=%#v already exists", name)
+	}
+
+	password := ""
+	if !options.PeerAuth {
+		var err error
+		password, err = randomHex(8)
+		if err != nil {
+			return err
+		}
+	}
+
+	conn, err := pgx.Connect(ctx, i.URL())
+	if err != nil {
+		return err
+	}
+	defer conn.Close(ctx)
+
+	statement := "CREATE ROLE " + doubleQuoteIdentifier(name) + " WITH LOGIN"
+	if options.CreateDB {
+		statement += " CREATEDB"
+	}
+	if options.CreateRole {
+		statement += " CREATEROLE"
+	}
+	if options.PeerAuth {
+		_, err = conn.Exec(ctx, statement)
+	} else {
+		// CREATE ROLE needs the simple protocol for the $1 parameter replacement to work
+		_, err = conn.Exec(ctx, statement+" PASSWORD $1", pgx.QueryExecModeSimpleProtocol, password)
+	}
+	if err != nil {
+		return err
+	}
+	for _, role := range options.MemberOf {
+		_, err = conn.Exec(ctx, "GRANT "+doubleQuoteIdentifier(role)+" TO "+doubleQuoteIdentifier(name))
+		if err != nil {
+			return err
+		}
+	}
+
+	// the default rules trust all local connections, so add rules for this user before them
+	var rules string
+	if options.PeerAuth {
+		// this is not the same as i.username when running as root: see Options.UnprivilegedUser
+		currentUser, err := user.Current()
+		if err != nil {
+			return err
+		}
+		err = appendIdentConfig(i.dbDir,
+			fmt.Sprintf("%s %s %s\n", peerAuthMapName, currentUser.Username, name))
+		if err != nil {
+			return err
+		}
+		rules = fmt.Sprintf("local all %s peer map=%s\n", name, peerAuthMapName)
+	} else {
+		rules = fmt.Sprintf("local all %s scram-sha-256\nhost all %s all scram-sha-256\n", name, name)
+	}
+	err = prependAuthConfig(i.dbDir, rules)
+	if err != nil {
+		return err
+	}
+	err = reloadConfig(ctx, conn, i.URL())
+	if err != nil {
+		return err
+	}
+
+	if i.users == nil {
+		i.users = map[string]string{}
+	}
+	i.users[name] = password
+	return conn.Close(ctx)
+}
+
+// URLForUser returns the Postgres connection URL to connect as a user created by CreateUser,
+// using a Unix socket. It includes the user's password, unless it uses peer authentication.
+func (i *Instance) URLForUser(name string) string {
+	i.usersMu.Lock()
+	password := i.users[name]
+	i.usersMu.Unlock()
+
+	userInfo := url.User(name)
+	if password != "" {
+		userInfo = url.UserPassword(name, password)
+	}
+	u := &url.URL{
+		Scheme:   "postgresql",
+		User:     userInfo,
+		Path:     "/" + defaultDatabase,
+		RawQuery: "host=" + i.dbDir + "&port=" + strconv.Itoa(i.port()),
+	}
+	return u.String()
+}
+
+// appendIdentConfig appends lines to pg_ident.conf in dir.
+func appendIdentConfig(dir string, lines string) error {
+	f, err := os.OpenFile(filepath.Join(dir, pgIdentConfigFileName), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(lines)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// reloadConfig tells Postgres to reload its configuration files using conn, and waits until new
+// connections to pgURL use the new configuration. pg_reload_conf() only signals the server, so
+// connections made immediately after it returns may still use the old configuration.
+func reloadConfig(ctx context.Context, conn *pgx.Conn, pgURL string) error {
+	var loadTime time.Time
+	err := conn.QueryRow(ctx, `SELECT pg_conf_load_time()`).Scan(&loadTime)
+	if err != nil {
+		return err
+	}
+	var reloaded bool
+	err = conn.QueryRow(ctx, `SELECT pg_reload_conf()`).Scan(&reloaded)
+	if err != nil {
+		return err
+	}
+	if !reloaded {
+		return fmt.Errorf("postgrestest: pg_reload_conf() failed")
+	}
+
+	// each new connection reports the time the postmaster last loaded the configuration
+	for {
+		newLoadTime, err := queryConfigLoadTime(ctx, pgURL)
+		if err != nil {
+			return err
+		}
+		if newLoadTime.After(loadTime) {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(reloadPollInterval):
+		}
+	}
+}
+
+// queryConfigLoadTime connects to pgURL and returns pg_conf_load_time().
+func queryConfigLoadTime(ctx context.Context, pgURL string) (time.Time, error) {
+	conn, err := pgx.Connect(ctx, pgURL)
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer conn.Close(ctx)
+	var loadTime time.Time
+	err = conn.QueryRow(ctx, `SELECT pg_conf_load_time()`).Scan(&loadTime)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return loadTime, conn.Close(ctx)
+}
@@ -0,0 +1,122 @@
+package postgrestest
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/evanj/hacks/pgwire"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestCreateUser(t *testing.T) {
+	instance, err := NewInstance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer instance.Close()
+
+	ctx := context.Background()
+	err = instance.execSQL(ctx, defaultDatabase,
+		`CREATE TABLE example (id INTEGER PRIMARY KEY)`,
+		`INSERT INTO example VALUES (1)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, invalid := range []string{"", "Upper", "1digit", `quote"`, "space name"} {
+		err = instance.CreateUser(ctx, invalid, UserOptions{})
+		if err == nil {
+			t.Errorf("CreateUser(%#v) must return an error", invalid)
+		}
+	}
+
+	err = instance.CreateUser(ctx, "app", UserOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = instance.CreateUser(ctx, "app", UserOptions{})
+	if err == nil {
+		t.Error("CreateUser with a duplicate name must return an error")
+	}
+	err = instance.CreateUser(ctx, "reader", UserOptions{
+		MemberOf: []string{"pg_read_all_data"}, PeerAuth: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	appURL := instance.URLForUser("app")
+	if !strings.Contains(appURL, "app:") {
+		t.Errorf("URLForUser must contain the password: %s", appURL)
+	}
+	conn, err := pgx.Connect(ctx, appURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(ctx)
+	var currentUser string
+	err = conn.QueryRow(ctx, `SELECT current_user`).Scan(&currentUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if currentUser != "app" {
+		t.Errorf("expected current_user=app; was %#v", currentUser)
+	}
+	var count int
+	err = conn.QueryRow(ctx, `SELECT COUNT(*) FROM example`).Scan(&count)
+	var pgErr *pgconn.PgError
+	if !(errors.As(err, &pgErr) && pgErr.Code == "42501") {
+		t.Errorf("expected insufficient_privilege error; err=%v", err)
+	}
+
+	// pgwire supports SCRAM-SHA-256 authentication
+	parsedURL, err := pgx.ParseConfig(appURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wireConn, err := pgwire.Connect(ctx, pgwire.Config{
+		Network:  "unix",
+		Address:  instance.socketPath(),
+		User:     "app",
+		Password: parsedURL.Password,
+		Database: defaultDatabase,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wireConn.Close()
+	results, err := wireConn.SimpleQuery(ctx, `SELECT current_user`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *results[0].Rows[0][0] != "app" {
+		t.Errorf("expected current_user=app; was %#v", *results[0].Rows[0][0])
+	}
+
+	// the password is required
+	wrongPasswordURL := strings.Replace(appURL, "app:", "app:wrong", 1)
+	_, err = pgx.Connect(ctx, wrongPasswordURL)
+	if err == nil {
+		t.Error("connecting with the wrong password must fail")
+	}
+
+	readerURL := instance.URLForUser("reader")
+	conn, err = pgx.Connect(ctx, readerURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(ctx)
+	err = conn.QueryRow(ctx, `SELECT COUNT(*) FROM example`).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("expected count=1; was %d", count)
+	}
+	_, err = conn.Exec(ctx, `INSERT INTO example VALUES (2)`)
+	if !(errors.As(err, &pgErr) && pgErr.Code == "42501") {
+		t.Errorf("expected insufficient_privilege error; err=%v", err)
+	}
+}
@@ -0,0 +1,168 @@
+package postgrestest
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/evanj/hacks/nilslog"
+	"golang.org/x/exp/slices"
+	"golang.org/x/exp/slog"
+)
+
+// Directories where packages install multiple versions of Postgres side by side.
+var installedBinDirPatterns = []string{
+	// Debian/Ubuntu
+	"/usr/lib/postgresql/*/bin",
+	// Red Hat/Fedora packages from postgresql.org
+	"/usr/pgsql-*/bin",
+	// Homebrew on Apple Silicon and Intel
+	"/opt/homebrew/opt/postgresql@*/bin",
+	"/usr/local/opt/postgresql@*/bin",
+}
+
+// InstalledVersion is a version of Postgres found by InstalledVersions.
+type InstalledVersion struct {
+	// Major version number e.g. 15
+	Major int
+	// Output of postgres --version e.g. "PostgreSQL 15.14 (Debian 15.14-0+deb12u1)"
+	Version string
+	// Directory containing the Postgres binaries
+	BinDir string
+}
+
+// Options returns Options that use this version of Postgres.
+func (v InstalledVersion) Options() Options {
+	return Options{BinDir: v.BinDir}
+}
+
+// InstalledVersions returns the versions of Postgres installed in standard locations, and the
+// version found with pg_config on PATH, sorted by major version. If a major version is installed
+// more than once, it returns the first one found.
+func InstalledVersions() ([]InstalledVersion, error) {
+	logger := nilslog.New()
+	var binDirs []string
+	for _, pattern := range installedBinDirPatterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return nil, err
+		}
+		binDirs = append(binDirs, matches...)
+	}
+	cfg, err := readPGConfig(logger)
+	if err == nil {
+		binDirs = append(binDirs, cfg.path)
+	}
+
+	var versions []InstalledVersion
+	for _, binDir := range binDirs {
+		_, err := os.Stat(filepath.Join(binDir, "postgres"))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		cfg, err := readBinDirConfig(logger, binDir)
+		if err != nil {
+			return nil, err
+		}
+		major, err := cfg.majorVersionNumber()
+		if err != nil {
+			return nil, err
+		}
+		alreadyFound := slices.ContainsFunc(versions, func(v InstalledVersion) bool {
+			return v.Major == major
+		})
+		if !alreadyFound {
+			versions = append(versions, InstalledVersion{major, cfg.version, binDir})
+		}
+	}
+	slices.SortFunc(versions, func(a InstalledVersion, b InstalledVersion) int {
+		return a.Major - b.Major
+	})
+	return versions, nil
+}
+
+// RunEachVersion calls f as a subtest for each version returned by InstalledVersions, with
+// Options that use that version. Tests should pass the options to NewWithOptions. It calls
+// t.Fatal if Postgres is not installed.
+func RunEachVersion(t *testing.T, f func(t *testing.T, options Options)) {
+	versions, err := InstalledVersions()
+	if err != nil {
+		t.Fatalf("failed finding Postgres versions: %s", err.Error())
+	}
+	if len(versions) == 0 {
+		t.Fatal("no Postgres versions found")
+	}
+	for _, version := range versions {
+		t.Run(fmt.Sprintf("postgres%d", version.Major), func(t *testing.T) {
+			f(t, version.Options())
+		})
+	}
+}
+
+// readBinDirConfig returns the pgConfig for the Postgres binaries in binDir.
+func readBinDirConfig(logger *slog.Logger, binDir string) (*pgConfig, error) {
+	cfg := &pgConfig{path: binDir}
+	out, err := command(logger, cfg.binPath("postgres"), "--version").Output()
+	if err != nil {
+		return nil, err
+	}
+	// "postgres (PostgreSQL) 15.14": remove the prefix to match pg_config --version
+	version := string(bytes.TrimSpace(out))
+	cfg.version = "PostgreSQL " + strings.TrimPrefix(version, "postgres (PostgreSQL) ")
+	return cfg, nil
+}
+
+// findPGConfig returns the pgConfig for the Postgres selected by options.
+func findPGConfig(options Options) (*pgConfig, error) {
+	if options.BinDir != "" {
+		cfg, err := readBinDirConfig(options.Logger, options.BinDir)
+		if err != nil {
+			return nil, err
+		}
+		if options.Version != 0 {
+			major, err := cfg.majorVersionNumber()
+			if err != nil {
+				return nil, err
+			}
+			if major != options.Version {
+				return nil, fmt.Errorf("postgrestest: BinDir=%s is version %d; Version=%d",
+					options.BinDir, major, options.Version)
+			}
+		}
+		return cfg, nil
+	}
+
+	if options.Version != 0 {
+		versions, err := InstalledVersions()
+		if err != nil {
+			return nil, err
+		}
+		for _, version := range versions {
+			if version.Major == options.Version {
+				return &pgConfig{path: version.BinDir, version: version.Version}, nil
+			}
+		}
+		return nil, fmt.Errorf("postgrestest: Postgres version %d is not installed", options.Version)
+	}
+
+	return readPGConfig(options.Logger)
+}
+
+// majorVersionNumber returns the major version as a number. Postgres versions before 10 return the
+// first number only.
+func (p *pgConfig) majorVersionNumber() (int, error) {
+	major, err := p.majorVersion()
+	if err != nil {
+		return 0, err
+	}
+	first, _, _ := strings.Cut(major, ".")
+	return strconv.Atoi(first)
+}
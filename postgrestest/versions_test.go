@@ -0,0 +1,66 @@
+package postgrestest
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func TestInstalledVersions(t *testing.T) {
+	versions, err := InstalledVersions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, version := range versions {
+		t.Logf("found Postgres %d in %s: %s", version.Major, version.BinDir, version.Version)
+		_, err = os.Stat(filepath.Join(version.BinDir, "postgres"))
+		if err != nil {
+			t.Error(err)
+		}
+		if i > 0 && versions[i-1].Major >= version.Major {
+			t.Errorf("versions must be sorted and unique: %d then %d", versions[i-1].Major, version.Major)
+		}
+	}
+}
+
+func TestNewInstanceWithOptionsVersionNotInstalled(t *testing.T) {
+	instance, err := NewInstanceWithOptions(context.Background(), Options{Version: 1})
+	if instance != nil {
+		t.Error(instance)
+	}
+	if err == nil || !strings.Contains(err.Error(), "version 1 is not installed") {
+		t.Errorf("expected not installed error; err=%v", err)
+	}
+}
+
+func TestRunEachVersion(t *testing.T) {
+	RunEachVersion(t, func(t *testing.T, options Options) {
+		pgURL := NewWithOptions(t, options)
+		ctx := context.Background()
+		conn, err := pgx.Connect(ctx, pgURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close(ctx)
+
+		var serverVersionNum string
+		err = conn.QueryRow(ctx, `SHOW server_version_num`).Scan(&serverVersionNum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// server_version_num is major*10000 + minor e.g. 150014
+		major, err := strconv.Atoi(serverVersionNum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := "postgres" + strconv.Itoa(major/10000)
+		if !strings.HasSuffix(t.Name(), "/"+expected) {
+			t.Errorf("test %s connected to server_version_num=%s", t.Name(), serverVersionNum)
+		}
+	})
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
@@ -28,7 +29,7 @@ func startPostgresAndPSQL(listenOnLocalhost bool, verbose bool, insecureGlobalPo
 		InsecureGlobalPort: insecureGlobalPort,
 		DirPath:            dir,
 	}
-	instance, err := postgrestest.NewInstanceWithOptions(options)
+	instance, err := postgrestest.NewInstanceWithOptions(context.Background(), options)
 	if err != nil {
 		panic(err)
 	}
@@ -66,12 +67,29 @@ func startPostgresAndPSQL(listenOnLocalhost bool, verbose bool, insecureGlobalPo
 	}
 }
 
+// reap deletes temporary instances left behind by processes that exited without cleaning up.
+func reap() {
+	reaped, err := postgrestest.Reap()
+	for _, dir := range reaped {
+		fmt.Printf("reaped %s\n", dir)
+	}
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("reaped %d temporary instances\n", len(reaped))
+}
+
 func main() {
 	listenOnLocalhost := flag.Bool("listenOnLocalhost", false, "Listens on localhost if set")
 	insecureGlobalPort := flag.Int("insecureGlobalPort", 0, "If set, listens for global TCP connections")
 	verbose := flag.Bool("verbose", false, "Logs verbose commands if set")
 	dir := flag.String("dir", "", "If not empty, use and/or create DB in this dir (for reusing directory)")
+	reapFlag := flag.Bool("reap", false, "Deletes leaked temporary instances then exits")
 	flag.Parse()
 
+	if *reapFlag {
+		reap()
+		return
+	}
 	startPostgresAndPSQL(*listenOnLocalhost, *verbose, *insecureGlobalPort, *dir)
 }